@@ -0,0 +1,89 @@
+package main
+
+import (
+	"math"
+	"sync"
+)
+
+// directionSkewAlpha is the smoothing factor of the exponentially weighted
+// moving average of the download/upload ratio.
+const directionSkewAlpha = 0.2
+
+// directionSkewRebaseline is the number of consecutive anomalous ratios after
+// which the history is reset to the last ratio, assuming that the connection
+// changed, e.g. after an upgrade of the upload speed.
+const directionSkewRebaseline = 3
+
+// directionSkew tracks the historical ratio between download and upload
+// speeds, to detect runs where one direction is way off compared to the
+// other. It is safe for concurrent use.
+type directionSkew struct {
+	mu sync.Mutex
+	// norm is the moving average of the download/upload ratio, or 0 if
+	// there is no history yet.
+	norm float64
+	// anomalies is the number of consecutive anomalous ratios.
+	anomalies int
+}
+
+// check returns true if the download/upload ratio deviates from the
+// historical norm by more than a factor of maxSkew, or if either direction is
+// zero. Results that are not anomalous are added to the history, and after
+// directionSkewRebaseline consecutive anomalous ones the history restarts from
+// the last ratio.
+func (d *directionSkew) check(download, upload, maxSkew float64) bool {
+	if download <= 0 || upload <= 0 {
+		return true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ratio := download / upload
+	if d.norm == 0 {
+		d.norm = ratio
+		return false
+	}
+	if skew := ratio / d.norm; math.Max(skew, 1/skew) > maxSkew {
+		d.anomalies++
+		if d.anomalies >= directionSkewRebaseline {
+			d.norm = ratio
+			d.anomalies = 0
+		}
+		return true
+	}
+	d.anomalies = 0
+	d.norm = directionSkewAlpha*ratio + (1-directionSkewAlpha)*d.norm
+	return false
+}
+
+// reset clears the history.
+func (d *directionSkew) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.norm = 0
+	d.anomalies = 0
+}
+
+// serverHistory keeps the IDs of the servers used by the last runs, to detect
+// when speedtest-cli keeps picking the same server in random mode.
+type serverHistory struct {
+	size int
+	ids  []string
+}
+
+// add records a server ID, and returns true if the last `size` runs all used
+// the same server.
+func (h *serverHistory) add(id string) bool {
+	h.ids = append(h.ids, id)
+	if len(h.ids) > h.size {
+		h.ids = h.ids[len(h.ids)-h.size:]
+	}
+	if len(h.ids) < h.size {
+		return false
+	}
+	for _, other := range h.ids {
+		if other != id {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditRecord is a single line of the audit log.
+type auditRecord struct {
+	Timestamp time.Time      `json:"timestamp"`
+	Backend   string         `json:"backend"`
+	ServerIDs []int          `json:"server_ids,omitempty"`
+	Success   bool           `json:"success"`
+	Error     string         `json:"error,omitempty"`
+	Retries   int            `json:"retries"`
+	Result    *resultPayload `json:"result,omitempty"`
+}
+
+// auditLog appends one JSON record per run to a file, as a machine-readable
+// record independent of the Prometheus retention.
+type auditLog struct {
+	mu    sync.Mutex
+	f     *os.File
+	fsync bool
+}
+
+func newAuditLog(path string, fsync bool) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &auditLog{f: f, fsync: fsync}, nil
+}
+
+func (l *auditLog) record(rec auditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit record: %w", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+	if l.fsync {
+		if err := l.f.Sync(); err != nil {
+			return fmt.Errorf("failed to sync audit log: %w", err)
+		}
+	}
+	return nil
+}
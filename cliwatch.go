@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// cliWatcher detects changes to the speedtest CLI binary, e.g. after a silent
+// package update.
+type cliWatcher struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// check stats the CLI binary and returns its modification time, and whether
+// its modification time or size changed since the previous check. The first
+// check never reports a change.
+func (w *cliWatcher) check() (time.Time, bool, error) {
+	path, err := exec.LookPath(w.path)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to find %q: %w", w.path, err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to stat %q: %w", path, err)
+	}
+	changed := !w.modTime.IsZero() && (!fi.ModTime().Equal(w.modTime) || fi.Size() != w.size)
+	w.modTime = fi.ModTime()
+	w.size = fi.Size()
+	return w.modTime, changed, nil
+}
+
+// cliVersionTimeout is the maximum duration of `speedtest-cli --version`.
+const cliVersionTimeout = 10 * time.Second
+
+var cliVersionRegexp = regexp.MustCompile(`\d+(\.\d+)+`)
+
+// cliVersion runs the speedtest CLI with --version and returns the first
+// version number it prints, e.g. "2.1.3" for "speedtest-cli 2.1.3". If there
+// is none, the whole first line is returned.
+func cliVersion(cliPath string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cliVersionTimeout)
+	defer cancel()
+	cmd := commandContext(ctx, cliPath, "--version")
+	var outb bytes.Buffer
+	cmd.Stdout = &outb
+	if err := runCommand(cmd); err != nil {
+		return "", fmt.Errorf("failed to get speedtest CLI version: %w", err)
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(outb.String()), "\n")
+	if v := cliVersionRegexp.FindString(line); v != "" {
+		return v, nil
+	}
+	return strings.TrimSpace(line), nil
+}
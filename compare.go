@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// measurement is the subset of a speedtest result that is compared against
+// the baseline.
+type measurement struct {
+	Download  float64   `json:"download_bits_per_second"`
+	Upload    float64   `json:"upload_bits_per_second"`
+	Ping      float64   `json:"ping_msec"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func newMeasurement(res *speedTestResult) measurement {
+	return measurement{
+		Download:  res.Download,
+		Upload:    res.Upload,
+		Ping:      res.Ping,
+		Timestamp: res.Timestamp,
+	}
+}
+
+// comparison is the response of the /compare endpoint. Deltas are expressed
+// as percentage of the baseline values.
+type comparison struct {
+	Baseline measurement `json:"baseline"`
+	Latest   measurement `json:"latest"`
+	Delta    struct {
+		Download float64 `json:"download_percent"`
+		Upload   float64 `json:"upload_percent"`
+		Ping     float64 `json:"ping_percent"`
+	} `json:"delta"`
+}
+
+// baselineStore holds the baseline measurement, optionally persisted to a
+// file. It is safe for concurrent use.
+type baselineStore struct {
+	mu       sync.Mutex
+	path     string
+	baseline *measurement
+}
+
+// loadBaseline returns a baseline store backed by the given file. If the file
+// doesn't exist yet, the store is empty. If path is empty, the baseline is
+// only kept in memory.
+func loadBaseline(path string) (*baselineStore, error) {
+	s := baselineStore{path: path}
+	if path == "" {
+		return &s, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &s, nil
+		}
+		return nil, fmt.Errorf("failed to read baseline file: %w", err)
+	}
+	var m measurement
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal baseline file: %w", err)
+	}
+	s.baseline = &m
+	return &s, nil
+}
+
+func (s *baselineStore) get() *measurement {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.baseline
+}
+
+func (s *baselineStore) set(m measurement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.baseline = &m
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal baseline: %w", err)
+	}
+	if err := os.WriteFile(s.path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write baseline file: %w", err)
+	}
+	return nil
+}
+
+func percentDelta(baseline, latest float64) float64 {
+	if baseline == 0 {
+		return 0
+	}
+	return (latest - baseline) / baseline * 100
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Warningf("Failed to write JSON response: %v", err)
+	}
+}
+
+// baselineHandler returns a handler that stores the last result as the new
+// baseline on POST, and returns the current baseline on GET.
+func baselineHandler(results *resultStore, baseline *baselineStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			b := baseline.get()
+			if b == nil {
+				http.Error(w, "no baseline set", http.StatusNotFound)
+				return
+			}
+			writeJSON(w, b)
+		case http.MethodPost:
+			res := results.get()
+			if res == nil {
+				http.Error(w, "no speedtest result available yet", http.StatusServiceUnavailable)
+				return
+			}
+			m := newMeasurement(res)
+			if err := baseline.set(m); err != nil {
+				logrus.Warningf("Failed to store baseline: %v", err)
+				http.Error(w, "failed to store baseline", http.StatusInternalServerError)
+				return
+			}
+			logrus.Infof("New baseline set by %s: %+v", r.RemoteAddr, m)
+			writeJSON(w, m)
+		default:
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// compareHandler returns a handler that compares the last result against the
+// baseline.
+func compareHandler(results *resultStore, baseline *baselineStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		b := baseline.get()
+		if b == nil {
+			http.Error(w, "no baseline set", http.StatusNotFound)
+			return
+		}
+		res := results.get()
+		if res == nil {
+			http.Error(w, "no speedtest result available yet", http.StatusServiceUnavailable)
+			return
+		}
+		c := comparison{
+			Baseline: *b,
+			Latest:   newMeasurement(res),
+		}
+		c.Delta.Download = percentDelta(b.Download, res.Download)
+		c.Delta.Upload = percentDelta(b.Upload, res.Upload)
+		c.Delta.Ping = percentDelta(b.Ping, res.Ping)
+		writeJSON(w, c)
+	}
+}
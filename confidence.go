@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bounds used to decide whether a run lasted a reasonable amount of time.
+// speedtest-cli normally takes between 20 and 40 seconds, so anything outside
+// of these bounds is suspicious.
+const (
+	confidenceMinDuration = 10 * time.Second
+	confidenceMaxDuration = 2 * time.Minute
+)
+
+// confidenceMaxDistanceKm is the server distance above which the distance
+// score starts decreasing.
+const confidenceMaxDistanceKm = 500
+
+// confidenceWeights holds the weight of each signal used to compute the
+// result confidence. Weights are relative to each other and don't need to sum
+// up to 1.
+type confidenceWeights struct {
+	Retries  float64
+	Duration float64
+	Zero     float64
+	Distance float64
+}
+
+var defaultConfidenceWeights = confidenceWeights{
+	Retries:  1,
+	Duration: 1,
+	Zero:     1,
+	Distance: 1,
+}
+
+// parseConfidenceWeights parses a comma-separated list of name=weight pairs,
+// e.g. "retries=1,duration=0.5,zero=2,distance=0". Signals that are not
+// specified keep their default weight.
+func parseConfidenceWeights(s string) (*confidenceWeights, error) {
+	w := defaultConfidenceWeights
+	if err := parseWeights(s, map[string]*float64{
+		"retries":  &w.Retries,
+		"duration": &w.Duration,
+		"zero":     &w.Zero,
+		"distance": &w.Distance,
+	}); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// parseWeights parses a comma-separated list of name=value pairs into the
+// given values, indexed by name. Values cannot be negative.
+func parseWeights(s string, values map[string]*float64) error {
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return fmt.Errorf("invalid weight %q, expected name=value", kv)
+		}
+		weight, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid value for weight %q: %w", name, err)
+		}
+		if weight < 0 {
+			return fmt.Errorf("weight %q cannot be negative", name)
+		}
+		v, ok := values[name]
+		if !ok {
+			return fmt.Errorf("unknown weight %q", name)
+		}
+		*v = weight
+	}
+	return nil
+}
+
+// resultConfidence returns a score between 0 and 1 expressing how much a
+// result can be trusted. It is the weighted average of the following scores:
+//   - retries: 1/(1+retries), where retries is the number of retryable
+//     failures before the result was obtained
+//   - duration: 1 if the run lasted between confidenceMinDuration and
+//     confidenceMaxDuration, 0 otherwise
+//   - zero: 1 if download, upload and ping are all non-zero, 0 otherwise
+//   - distance: 1 if the server is within confidenceMaxDistanceKm, otherwise
+//     confidenceMaxDistanceKm divided by the server distance
+func resultConfidence(res *speedTestResult, w confidenceWeights) float64 {
+	retries := 1 / (1 + float64(res.Retries))
+	duration := 0.0
+	if res.Duration >= confidenceMinDuration && res.Duration <= confidenceMaxDuration {
+		duration = 1
+	}
+	zero := 0.0
+	if res.Download > 0 && res.Upload > 0 && res.Ping > 0 {
+		zero = 1
+	}
+	distance := 1.0
+	if res.Server.D > confidenceMaxDistanceKm {
+		distance = confidenceMaxDistanceKm / res.Server.D
+	}
+	total := w.Retries + w.Duration + w.Zero + w.Distance
+	if total == 0 {
+		return 0
+	}
+	return (w.Retries*retries + w.Duration*duration + w.Zero*zero + w.Distance*distance) / total
+}
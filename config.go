@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config is the configuration file loaded with -config. Every field
+// corresponds to a flag, and is nil if it's not in the file.
+type config struct {
+	Listen        *string        `yaml:"listen"`
+	Path          *string        `yaml:"path"`
+	SpeedTestCLI  *string        `yaml:"speedtest_cli"`
+	ServerID      *int           `yaml:"server_id"`
+	Interval      *time.Duration `yaml:"interval"`
+	RetryInterval *time.Duration `yaml:"retry_interval"`
+	MaxDistance   *int           `yaml:"max_distance"`
+	ServerRegexp  *string        `yaml:"server_regexp"`
+}
+
+// loadConfig loads a YAML configuration file. Unknown keys are rejected, so
+// that typos don't go unnoticed.
+func loadConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	var cfg config
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %q: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// flagValues returns the values set in the configuration file, indexed by
+// flag name.
+func (c *config) flagValues() map[string]string {
+	values := make(map[string]string)
+	if c.Listen != nil {
+		values["l"] = *c.Listen
+	}
+	if c.Path != nil {
+		values["p"] = *c.Path
+	}
+	if c.SpeedTestCLI != nil {
+		values["s"] = *c.SpeedTestCLI
+	}
+	if c.ServerID != nil {
+		values["S"] = strconv.Itoa(*c.ServerID)
+	}
+	if c.Interval != nil {
+		values["i"] = c.Interval.String()
+	}
+	if c.RetryInterval != nil {
+		values["r"] = c.RetryInterval.String()
+	}
+	if c.MaxDistance != nil {
+		values["m"] = strconv.Itoa(*c.MaxDistance)
+	}
+	if c.ServerRegexp != nil {
+		values["R"] = *c.ServerRegexp
+	}
+	return values
+}
+
+// envFlags maps flag names to the environment variables that can set them.
+var envFlags = map[string]string{
+	"l": "SPEEDTEST_LISTEN",
+	"p": "SPEEDTEST_PATH",
+	"s": "SPEEDTEST_CLI",
+	"S": "SPEEDTEST_SERVER_ID",
+	"i": "SPEEDTEST_INTERVAL",
+	"r": "SPEEDTEST_RETRY_INTERVAL",
+	"I": "SPEEDTEST_INSECURE",
+	"m": "SPEEDTEST_MAX_DISTANCE",
+	"R": "SPEEDTEST_SERVER_REGEXP",
+}
+
+// envFlagValues returns the values of the environment variables in envFlags
+// that are set, indexed by flag name.
+func envFlagValues() map[string]string {
+	values := make(map[string]string)
+	for name, env := range envFlags {
+		if value, ok := os.LookupEnv(env); ok {
+			values[name] = value
+		}
+	}
+	return values
+}
+
+// applyFlagValues sets the given flags, except those in `set`, which are added
+// to `set` once applied. This gives precedence to the flags passed on the
+// command line over the other configuration sources.
+func applyFlagValues(values map[string]string, set map[string]bool) error {
+	for name, value := range values {
+		if set[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for -%s: %w", value, name, err)
+		}
+		set[name] = true
+	}
+	return nil
+}
+
+// commandLineFlags returns the names of the flags set on the command line.
+func commandLineFlags() map[string]bool {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
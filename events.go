@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// event is a significant event, in a format compatible with Grafana's JSON
+// annotations. Time is in milliseconds since the epoch.
+type event struct {
+	Time  int64    `json:"time"`
+	Title string   `json:"title"`
+	Text  string   `json:"text"`
+	Tags  []string `json:"tags"`
+}
+
+// eventLog is a size-bounded log of the most recent events. It is safe for
+// concurrent use.
+type eventLog struct {
+	mu     sync.Mutex
+	size   int
+	events []event
+}
+
+func newEventLog(size int) *eventLog {
+	return &eventLog{size: size}
+}
+
+// add records a new event, dropping the oldest one if the log is full.
+func (l *eventLog) add(title, text string, tags ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size <= 0 {
+		return
+	}
+	if len(l.events) >= l.size {
+		l.events = l.events[1:]
+	}
+	l.events = append(l.events, event{
+		Time:  time.Now().UnixMilli(),
+		Title: title,
+		Text:  text,
+		Tags:  tags,
+	})
+}
+
+// reset clears the log.
+func (l *eventLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = nil
+}
+
+// list returns the events between from and to, in milliseconds since the
+// epoch, oldest first. A zero bound is ignored.
+func (l *eventLog) list(from, to int64) []event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	events := make([]event, 0, len(l.events))
+	for _, e := range l.events {
+		if (from != 0 && e.Time < from) || (to != 0 && e.Time > to) {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// annotationsHandler returns a handler that serves the recent events as a
+// JSON array of Grafana annotations. The optional `from` and `to` query
+// parameters, in milliseconds since the epoch, restrict the time range.
+func annotationsHandler(events *eventLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var bounds [2]int64
+		for idx, name := range []string{"from", "to"} {
+			v := r.URL.Query().Get(name)
+			if v == "" {
+				continue
+			}
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid "+name+" parameter", http.StatusBadRequest)
+				return
+			}
+			bounds[idx] = n
+		}
+		writeJSON(w, events.list(bounds[0], bounds[1]))
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fieldMap maps the fields of speedTestResult to dot-separated paths in the
+// speedtest CLI JSON output, e.g. "server.host" to "server.hostname". Array
+// elements are addressed by index, e.g. "servers.0.id". It allows adapting to
+// CLI versions whose output differs from the one of speedtest-cli.
+type fieldMap map[string]string
+
+// fieldSetters are the fields that can be overridden by a fieldMap.
+var fieldSetters = map[string]func(res *speedTestResult, v interface{}) error{
+	"download":       floatSetter(func(res *speedTestResult, f float64) { res.Download = f }),
+	"upload":         floatSetter(func(res *speedTestResult, f float64) { res.Upload = f }),
+	"ping":           floatSetter(func(res *speedTestResult, f float64) { res.Ping = f }),
+	"bytes_sent":     floatSetter(func(res *speedTestResult, f float64) { res.BytesSent = uint(f) }),
+	"bytes_received": floatSetter(func(res *speedTestResult, f float64) { res.BytesReceived = uint(f) }),
+	"jitter":         floatSetter(func(res *speedTestResult, f float64) { res.Jitter = &f }),
+	"packet_loss":    floatSetter(func(res *speedTestResult, f float64) { res.PacketLoss = &f }),
+	"timestamp": stringSetter(func(res *speedTestResult, s string) error {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return err
+		}
+		res.Timestamp = t
+		return nil
+	}),
+	"client.ip": stringSetter(func(res *speedTestResult, s string) error {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address %q", s)
+		}
+		res.Client.IP = ip
+		return nil
+	}),
+	"client.isp":      stringField(func(res *speedTestResult) *string { return &res.Client.ISP }),
+	"client.country":  stringField(func(res *speedTestResult) *string { return &res.Client.Country }),
+	"client.loggedin": stringField(func(res *speedTestResult) *string { return &res.Client.LoggedIn }),
+	"server.id":       stringField(func(res *speedTestResult) *string { return &res.Server.ID }),
+	"server.name":     stringField(func(res *speedTestResult) *string { return &res.Server.Name }),
+	"server.sponsor":  stringField(func(res *speedTestResult) *string { return &res.Server.Sponsor }),
+	"server.host":     stringField(func(res *speedTestResult) *string { return &res.Server.Host }),
+	"server.country":  stringField(func(res *speedTestResult) *string { return &res.Server.Country }),
+	"server.d":        floatSetter(func(res *speedTestResult, f float64) { res.Server.D = f }),
+	"server.latency":  floatSetter(func(res *speedTestResult, f float64) { res.Server.Latency = f }),
+}
+
+func floatSetter(set func(*speedTestResult, float64)) func(*speedTestResult, interface{}) error {
+	return func(res *speedTestResult, v interface{}) error {
+		var f float64
+		switch v := v.(type) {
+		case float64:
+			f = v
+		case string:
+			var err error
+			if f, err = strconv.ParseFloat(v, 64); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("expected a number, got %T", v)
+		}
+		set(res, f)
+		return nil
+	}
+}
+
+func stringSetter(set func(*speedTestResult, string) error) func(*speedTestResult, interface{}) error {
+	return func(res *speedTestResult, v interface{}) error {
+		switch v := v.(type) {
+		case string:
+			return set(res, v)
+		case float64:
+			return set(res, strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			return set(res, strconv.FormatBool(v))
+		default:
+			return fmt.Errorf("expected a string, got %T", v)
+		}
+	}
+}
+
+func stringField(field func(*speedTestResult) *string) func(*speedTestResult, interface{}) error {
+	return stringSetter(func(res *speedTestResult, s string) error {
+		*field(res) = s
+		return nil
+	})
+}
+
+// loadFieldMap reads a JSON object mapping field names to paths from the
+// given file.
+func loadFieldMap(path string) (fieldMap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var fm fieldMap
+	if err := json.Unmarshal(data, &fm); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for name := range fm {
+		if _, ok := fieldSetters[name]; !ok {
+			names := make([]string, 0, len(fieldSetters))
+			for n := range fieldSetters {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown field %q, valid fields are %s", name, strings.Join(names, ","))
+		}
+	}
+	return fm, nil
+}
+
+// apply overrides the fields of res with the values found at the mapped paths
+// of the raw JSON output.
+func (fm fieldMap) apply(raw []byte, res *speedTestResult) error {
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return fmt.Errorf("failed to unmarshal JSON result: %w", err)
+	}
+	for name, path := range fm {
+		v, err := lookupPath(doc, path)
+		if err != nil {
+			return fmt.Errorf("field %s: %w", name, err)
+		}
+		if err := fieldSetters[name](res, v); err != nil {
+			return fmt.Errorf("field %s at %q: %w", name, path, err)
+		}
+	}
+	return nil
+}
+
+// lookupPath returns the value at the given dot-separated path of a decoded
+// JSON document.
+func lookupPath(doc interface{}, path string) (interface{}, error) {
+	v := doc
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = node[key]; !ok {
+				return nil, fmt.Errorf("path %q not found", path)
+			}
+		case []interface{}:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 || idx >= len(node) {
+				return nil, fmt.Errorf("path %q not found", path)
+			}
+			v = node[idx]
+		default:
+			return nil, fmt.Errorf("path %q not found", path)
+		}
+	}
+	return v, nil
+}
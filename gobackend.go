@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	gospeedtest "github.com/showwin/speedtest-go/speedtest"
+	"github.com/sirupsen/logrus"
+)
+
+// backends are the valid values of -backend.
+var backends = map[string]bool{
+	"cli": true,
+	"go":  true,
+}
+
+// newGoClient returns a speedtest-go client bound to sourceIP, if not nil.
+func newGoClient(sourceIP net.IP) *gospeedtest.Speedtest {
+	cfg := gospeedtest.UserConfig{UserAgent: gospeedtest.DefaultUserAgent}
+	if sourceIP != nil {
+		cfg.Source = sourceIP.String()
+	}
+	return gospeedtest.New(gospeedtest.WithUserConfig(&cfg))
+}
+
+// goError converts an error of speedtest-go, reporting timeouts,
+// interruptions and connection failures like the speedtest CLI ones.
+func goError(ctx context.Context, timeout time.Duration, msg string, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %s", errTimeout, timeout)
+	} else if ctx.Err() != nil {
+		return fmt.Errorf("speedtest interrupted: %w", ctx.Err())
+	}
+	var (
+		opErr  *net.OpError
+		dnsErr *net.DNSError
+	)
+	if errors.As(err, &opErr) || errors.As(err, &dnsErr) {
+		return &retryableError{err: fmt.Errorf("%w: %s: %v", errConnection, msg, err)}
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+// goServers returns the server list as reported by speedtest-go, like
+// getServers does with `speedtest-cli --list`.
+func goServers(ctx context.Context, sourceIP net.IP, timeout time.Duration) ([]SpeedtestServer, error) {
+	ctx, cancel := cliContext(ctx, timeout)
+	defer cancel()
+	client := newGoClient(sourceIP)
+	// the distances are only computed from the client location if the user
+	// info is fetched first
+	if _, err := client.FetchUserInfoContext(ctx); err != nil {
+		return nil, goError(ctx, timeout, "failed to fetch user info", err)
+	}
+	list, err := client.FetchServerListContext(ctx)
+	if err != nil {
+		return nil, goError(ctx, timeout, "failed to fetch server list", err)
+	}
+	servers := make([]SpeedtestServer, 0, len(list))
+	for _, s := range list {
+		id, err := strconv.Atoi(s.ID)
+		if err != nil {
+			logrus.Debugf("Skipping server with invalid ID %q", s.ID)
+			continue
+		}
+		servers = append(servers, SpeedtestServer{
+			ID:         id,
+			Name:       fmt.Sprintf("%s (%s, %s)", s.Sponsor, s.Name, s.Country),
+			DistanceKm: s.Distance,
+			Country:    s.Country,
+		})
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no servers found")
+	}
+	return servers, nil
+}
+
+// goSpeedtest runs a speedtest with speedtest-go instead of the speedtest CLI.
+// Like speedtest-cli, it uses the lowest-latency server among opts.serverIDs,
+// or among all the servers if empty. The caller must hold cliMu.
+func goSpeedtest(ctx context.Context, opts speedtestOptions) (*speedTestResult, error) {
+	started := time.Now()
+	ctx, cancel := cliContext(ctx, opts.timeout)
+	defer cancel()
+	client := newGoClient(opts.sourceIP)
+	user, err := client.FetchUserInfoContext(ctx)
+	if err != nil {
+		return nil, goError(ctx, opts.timeout, "failed to fetch user info", err)
+	}
+	var server *gospeedtest.Server
+	if opts.miniURL != "" {
+		if server, err = client.CustomServer(opts.miniURL); err != nil {
+			return nil, fmt.Errorf("invalid server URL %q: %w", opts.miniURL, err)
+		}
+	} else {
+		var ids []string
+		for _, id := range opts.serverIDs {
+			if id != 0 {
+				ids = append(ids, strconv.Itoa(id))
+			}
+		}
+		var list gospeedtest.Servers
+		if len(ids) > 0 {
+			// the server list only has the nearest servers, look the wanted
+			// ones up by ID like `speedtest-cli --server` does
+			if list, err = goServersByID(ctx, client, ids, opts.timeout); err != nil {
+				return nil, err
+			}
+		} else if list, err = client.FetchServerListContext(ctx); err != nil {
+			return nil, goError(ctx, opts.timeout, "failed to fetch server list", err)
+		}
+		for _, s := range list {
+			if s.Latency <= 0 || s.Latency == gospeedtest.PingTimeout {
+				// the server didn't respond to the initial ping
+				continue
+			}
+			if server == nil || s.Latency < server.Latency {
+				server = s
+			}
+		}
+		if server == nil {
+			return nil, fmt.Errorf("no reachable server found among %v", opts.serverIDs)
+		}
+	}
+	// PingTestContext overwrites the latency measured when selecting the server
+	selectionLatency := server.Latency
+	if err := server.PingTestContext(ctx, nil); err != nil {
+		return nil, goError(ctx, opts.timeout, "ping test failed", err)
+	}
+	if !opts.pingOnly {
+		if err := server.DownloadTestContext(ctx); err != nil {
+			return nil, goError(ctx, opts.timeout, "download test failed", err)
+		}
+		if err := server.UploadTestContext(ctx); err != nil {
+			return nil, goError(ctx, opts.timeout, "upload test failed", err)
+		}
+	}
+	// the tests don't fail when the context is done, they just stop early
+	if ctx.Err() != nil {
+		return nil, goError(ctx, opts.timeout, "speedtest failed", ctx.Err())
+	}
+	jitter := float64(server.Jitter) / float64(time.Millisecond)
+	ret := speedTestResult{
+		// speedtest-go reports speeds in bytes per second, and -1 if not
+		// available
+		Download:      8 * max(float64(server.DLSpeed), 0),
+		Upload:        8 * max(float64(server.ULSpeed), 0),
+		Ping:          float64(server.Latency) / float64(time.Millisecond),
+		Timestamp:     started.UTC(), // like speedtest-cli, the start of the test
+		BytesSent:     uint(client.GetTotalUpload()),
+		BytesReceived: uint(client.GetTotalDownload()),
+		Jitter:        &jitter,
+		Started:       started,
+		Client: clientInfo{
+			IP:  net.ParseIP(user.IP),
+			Lat: user.Lat,
+			Lon: user.Lon,
+			ISP: user.Isp,
+		},
+		Server: serverInfo{
+			Lat:     server.Lat,
+			Lon:     server.Lon,
+			Name:    server.Name,
+			Country: server.Country,
+			Sponsor: server.Sponsor,
+			ID:      server.ID,
+			Host:    server.Host,
+			D:       server.Distance,
+			Latency: float64(selectionLatency) / float64(time.Millisecond),
+		},
+	}
+	logrus.Debugf("Speedtest results: %+v", ret)
+	return &ret, nil
+}
+
+// goServersByID looks up the servers with the given IDs and measures their
+// latency, like FetchServerListContext does for the nearest servers. Unknown
+// IDs are skipped.
+func goServersByID(ctx context.Context, client *gospeedtest.Speedtest, ids []string, timeout time.Duration) (gospeedtest.Servers, error) {
+	var list gospeedtest.Servers
+	for _, id := range ids {
+		s, err := client.FetchServerByIDContext(ctx, id)
+		if errors.Is(err, gospeedtest.ErrServerNotFound) {
+			logrus.Warningf("Server ID %s not found", id)
+			continue
+		} else if err != nil {
+			return nil, goError(ctx, timeout, fmt.Sprintf("failed to fetch server ID %s", id), err)
+		}
+		if err := s.PingTestContext(ctx, nil); err != nil {
+			logrus.Warningf("Server ID %s didn't respond to the ping: %v", id, err)
+			continue
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
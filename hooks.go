@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// runHook runs the given hook command through the shell, so that it can have
+// arguments, with the given additional environment variables, killing it
+// after timeout if greater than 0.
+func runHook(ctx context.Context, hook string, timeout time.Duration, env ...string) error {
+	ctx, cancel := cliContext(ctx, timeout)
+	defer cancel()
+	args := shellArgs(hook)
+	cmd := commandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	var outb, errb bytes.Buffer
+	cmd.Stdout = &outb
+	cmd.Stderr = &errb
+	logrus.Debugf("Executing command %+v", cmd)
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to execute hook %s: %w\nStdout: %s\nStderr: %s", hook, err, outb.String(), errb.String())
+	}
+	return nil
+}
+
+// postHookEnv returns the environment variables describing the outcome of a
+// run, passed to the -post-hook command.
+func postHookEnv(res *speedTestResult, err error) []string {
+	if err != nil {
+		return []string{"SPEEDTEST_SUCCESS=0", "SPEEDTEST_ERROR=" + err.Error()}
+	}
+	return []string{
+		"SPEEDTEST_SUCCESS=1",
+		"SPEEDTEST_DOWNLOAD=" + strconv.FormatFloat(res.Download, 'f', -1, 64),
+		"SPEEDTEST_UPLOAD=" + strconv.FormatFloat(res.Upload, 'f', -1, 64),
+		"SPEEDTEST_PING=" + strconv.FormatFloat(res.Ping, 'f', -1, 64),
+		"SPEEDTEST_SERVER_ID=" + res.Server.ID,
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// runHandler returns a handler that requests an immediate speedtest run to the
+// background loop. Requests are queued in `runRequests`, and when the queue is
+// full the handler responds with 429 Too Many Requests rather than blocking.
+func runHandler(runRequests chan<- struct{}, pending prometheus.Gauge) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		select {
+		case runRequests <- struct{}{}:
+			pending.Set(float64(len(runRequests)))
+			logrus.Infof("Speedtest run requested by %s", r.RemoteAddr)
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintln(w, "speedtest run scheduled")
+		default:
+			http.Error(w, "too many pending runs", http.StatusTooManyRequests)
+		}
+	}
+}
+
+// checkBearerToken returns true if the request carries the given bearer token.
+func checkBearerToken(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+// basicAuth returns a handler that requires the given HTTP Basic
+// authentication credentials before calling `next`.
+func basicAuth(user, pass string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		// compare both to avoid leaking which one is wrong through timing
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(p), []byte(pass)) == 1
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="speedtest-exporter"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// resetHandler returns a handler that calls `reset` to clear the in-memory
+// state. Requests must be authenticated with the given bearer token.
+func resetHandler(token string, reset func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !checkBearerToken(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		reset()
+		logrus.Infof("In-memory state reset by %s", r.RemoteAddr)
+		fmt.Fprintln(w, "state reset")
+	}
+}
+
+// probeHandler returns a handler that runs a speedtest synchronously and
+// serves the metrics of that run only, like blackbox_exporter's /probe, so
+// that Prometheus controls when speedtests are run. The server ID can be
+// chosen with the server_id query parameter, and defaults to the one returned
+// by `defaultServerID`, if not 0.
+// Every request gets fresh metrics from `newRegistry`.
+//
+// Only one speedtest runs at a time, since concurrent runs would compete for
+// bandwidth. If opts.noWait is set and a speedtest is already running, e.g.
+// from the background loop or another probe, the handler responds with 429
+// Too Many Requests instead of waiting for it to finish.
+//
+// Successful probes are stored in `results`. If cacheTTL is greater than 0,
+// the last result is served without running a speedtest as long as it is
+// younger than cacheTTL and matches the requested server, if any.
+func probeHandler(newRegistry func() (*metrics, *prometheus.Registry, error), results *resultStore, cacheTTL time.Duration, cliPath string, sourceAddress func() (net.IP, error), defaultServerID func() int, opts speedtestOptions, subnetBits int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// opts is shared by concurrent requests, only change a copy
+		opts := opts
+		id := r.URL.Query().Get("server_id")
+		if id != "" {
+			serverID, err := strconv.Atoi(id)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid server_id %q", id), http.StatusBadRequest)
+				return
+			}
+			opts.serverIDs = []int{serverID}
+		} else if serverID := defaultServerID(); serverID != 0 {
+			opts.serverIDs = []int{serverID}
+		}
+		m, reg, err := newRegistry()
+		if err != nil {
+			logrus.Warningf("Failed to set up probe metrics: %v", err)
+			http.Error(w, "failed to set up metrics", http.StatusInternalServerError)
+			return
+		}
+		success := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: m.namespace,
+			Name:      "probe_success",
+			Help:      "Whether the SpeedTest.net probe succeeded (1) or not (0)",
+		})
+		reg.MustRegister(success)
+		if cacheTTL > 0 {
+			last, updated := results.snapshot()
+			if last != nil && time.Since(updated) < cacheTTL && (id == "" || id == last.Server.ID) {
+				logrus.Infof("Serving cached speed test result from %s to %s", updated.Format(time.RFC3339), r.RemoteAddr)
+				m.results.setAt(last, updated)
+				m.setResult(last, subnetBits)
+				// the clock skew was measured when the result was obtained
+				reg.Unregister(m.clockSkew)
+				success.Set(1)
+				promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+				return
+			}
+		}
+		if opts.sourceIP, err = sourceAddress(); err != nil {
+			// don't silently run the speedtest from the default route
+			logrus.Warningf("Speed test probe failed: failed to get source address: %v", err)
+			m.setError()
+			promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+			return
+		}
+		logrus.Infof("Running speed test probe requested by %s with server IDs %v", r.RemoteAddr, opts.serverIDs)
+		start := time.Now()
+		res, err := speedtest(r.Context(), cliPath, opts)
+		if errors.Is(err, errBusy) {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		m.duration.Set(time.Since(start).Seconds())
+		if err == nil && opts.pingOnly {
+			// like the background loop, only update the ping
+			m.ping.Set(res.Ping)
+			success.Set(1)
+		} else if err == nil {
+			m.setResult(res, subnetBits)
+			m.setSamples([]*speedTestResult{res})
+			m.results.set(res)
+			results.set(res)
+			success.Set(1)
+		} else {
+			logrus.Warningf("Speed test probe failed: %v", err)
+			m.setError()
+		}
+		promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}
+}
+
+// lastResult is the response of the /last.json endpoint.
+type lastResult struct {
+	Time            time.Time      `json:"time"`
+	Result          *resultPayload `json:"result"`
+	Interface       string         `json:"interface,omitempty"`
+	Retries         int            `json:"retries"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	Stderr          string         `json:"stderr,omitempty"`
+	// Raw is the output of the speedtest CLI, before -field-map and
+	// -postprocess-script are applied
+	Raw json.RawMessage `json:"raw,omitempty"`
+}
+
+// lastResultHandler returns a handler that serves the last successful result
+// as JSON, together with the raw speedtest CLI output, for troubleshooting.
+func lastResultHandler(results *resultStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res, updated := results.snapshot()
+		if res == nil {
+			http.Error(w, "no speedtest result available yet", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, lastResult{
+			Time:            updated,
+			Result:          newResultPayload(res),
+			Interface:       res.Interface,
+			Retries:         res.Retries,
+			DurationSeconds: res.Duration.Seconds(),
+			Stderr:          res.Stderr,
+			Raw:             res.Raw,
+		})
+	}
+}
+
+// landingHandler returns a handler that serves a minimal HTML page linking to
+// the metrics, like most Prometheus exporters.
+func landingHandler(metricsPath string) http.HandlerFunc {
+	page := fmt.Sprintf(`<html>
+<head><title>Speedtest Exporter</title></head>
+<body>
+<h1>Speedtest Exporter</h1>
+<p><a href="%s">Metrics</a></p>
+<p>%s</p>
+</body>
+</html>
+`, html.EscapeString(metricsPath), html.EscapeString(versionString()))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, page)
+	}
+}
+
+// healthzHandler returns a handler for liveness and readiness probes, which
+// never runs a speedtest. If maxAge is greater than 0, it responds with 503
+// Service Unavailable when the last successful speedtest is older than
+// maxAge, or when there has been none for maxAge since startup.
+func healthzHandler(results *resultStore, maxAge time.Duration) http.HandlerFunc {
+	started := time.Now()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if maxAge > 0 {
+			age, ok := results.age()
+			if !ok {
+				age = time.Since(started)
+			}
+			if age > maxAge {
+				http.Error(w, fmt.Sprintf("no successful speedtest in the last %s", maxAge), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
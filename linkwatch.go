@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errLinkDown = errors.New("network interface is down")
+
+// linkWatcher tracks since when a network interface has been up, so that the
+// speedtest is only run once the connection had time to settle, e.g. after
+// PPPoE or DHCP completed following a reboot. It reads the operational state
+// from sysfs and is only supported on Linux.
+type linkWatcher struct {
+	iface   string
+	settle  time.Duration
+	upSince time.Time
+}
+
+// check returns how long to wait for the interface to settle, or errLinkDown
+// if the interface is down. The interface is considered to have just come up
+// on the first check, so that the first run after startup waits too.
+func (w *linkWatcher) check(now time.Time) (time.Duration, error) {
+	path := filepath.Join("/sys/class/net", w.iface, "operstate")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read state of interface %s: %w", w.iface, err)
+	}
+	// some point-to-point interfaces, e.g. ppp and tun, report "unknown"
+	// when they are up
+	if state := strings.TrimSpace(string(data)); state != "up" && state != "unknown" {
+		w.upSince = time.Time{}
+		return 0, fmt.Errorf("%w: %s is %s", errLinkDown, w.iface, state)
+	}
+	if w.upSince.IsZero() {
+		w.upSince = now
+	}
+	if wait := w.settle - now.Sub(w.upSince); wait > 0 {
+		return wait, nil
+	}
+	return 0, nil
+}
@@ -3,20 +3,32 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/insomniacslk/xjson"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
 	"github.com/sirupsen/logrus"
 )
 
@@ -26,26 +38,142 @@ var (
 	flagSpeedTestCLI      = flag.String("s", "speedtest-cli", "Path to speedtest-cli")
 	flagSpeedTestServerID = flag.Int("S", 0, "Server ID obtained with `speedtest-cli --list`")
 	flagSleepInterval     = flag.Duration("i", 30*time.Minute, "Interval between speedtest executions, expressed as a Go duration string")
-	flagRetryInterval     = flag.Duration("r", 1*time.Minute, "Interval between retries when 'speedtest --list' fails to find a server, expressed as a Go duration string")
+	flagTimeout           = flag.Duration("t", 5*time.Minute, "Maximum duration of a speedtest CLI run, expressed as a Go duration string. Runs taking longer are killed and considered failed. If 0, there is no timeout")
+	flagRetryInterval     = flag.Duration("r", 1*time.Minute, "Interval between retries when 'speedtest --list' fails to find a server, and before the second run if the first one failed, expressed as a Go duration string")
 	flagInsecure          = flag.Bool("I", false, "Insecure mode: use HTTP instead of HTTPS")
-	flagDebug             = flag.Bool("d", false, "Enable debugging output")
+	flagDebug             = flag.Bool("d", false, "Enable debugging output, same as -log-level debug")
+	flagLogLevel          = flag.String("log-level", "info", "Log level, one of trace, debug, info, warn and error")
+	flagLogFormat         = flag.String("log-format", "text", "Log format, text or json")
 	flagMaxDistance       = flag.Int("m", 0, "Max distance in km to the speedtest server")
 	flagServerRegexp      = flag.String("R", "", "Regular expression to match the candidate servers")
+	flagEnableMetrics     = flag.String("enable-metrics", "", "Comma-separated list of metrics to export (e.g. speed,ping). If empty, all the metrics are exported")
+	flagDisableMetrics    = flag.String("disable-metrics", "", "Comma-separated list of metrics not to export (e.g. ping)")
+	flagLabels            = flag.String("labels", "", "Comma-separated list of labels to add to the speed metric, among client_ip, client_isp, client_country, server_sponsor, server_host and server_country. They are opt-in, since they increase the metric cardinality")
+	flagIPSubnetBits      = flag.Int("ip-subnet-bits", 0, "If greater than 0, replace the client_ip label with its network prefix of this length (e.g. 24 for a /24)")
+	flagConfidenceWeights = flag.String("confidence-weights", "", "Comma-separated name=weight pairs overriding the weights used for speedtest_result_confidence. Valid names are retries, duration, zero and distance; weights default to 1")
+	flagServerIDURL       = flag.String("server-id-url", "", "URL returning the server ID to use, as plain text or JSON. It is fetched at startup and takes precedence over -S, which is used as fallback if the fetch fails")
+	flagServerIDRefresh   = flag.Bool("server-id-refresh", false, "Fetch the server ID from -server-id-url before every run instead of only at startup")
+	flagMaintenance       = flag.String("maintenance-windows", "", "Comma-separated list of local time ranges during which no speedtest is run, e.g. 22:00-06:00,12:00-13:00")
+	flagMaintenanceInvert = flag.Bool("maintenance-invert", false, "Invert -maintenance-windows, so that speedtests are run only within the given time ranges")
+	flagMaxPendingRuns    = flag.Int("max-pending-runs", 0, "Maximum number of runs that can be queued via the /run endpoint. Further requests are rejected with HTTP 429. If 0, the default, or with -background-loop=false, the /run endpoint is disabled")
+	flagBaselineFile      = flag.String("baseline-file", "", "File where the baseline set via POST /baseline is persisted, and loaded from at startup")
+	flagExcludeZeroDist   = flag.Bool("exclude-zero-distance", false, "Exclude servers reporting a distance of 0 km, which usually indicates a wrong geolocation")
+	flagPingOnly          = flag.Bool("ping-only", false, "Only measure latency, without running the download and upload tests. Only the ping metric is updated")
+	flagPingInterval      = flag.Duration("ping-interval", 0, "If greater than 0, run latency-only tests at this interval in addition to the full tests run every -i, expressed as a Go duration string")
+	flagTextfileOut       = flag.String("textfile-out", "", "If set, write the metrics to this file after each run, for node_exporter's textfile collector. The file name must end in .prom")
+	flagServerRank        = flag.Int("server-rank", 0, "If greater than 0, select the Nth closest server among the filtered candidates (1 is the closest)")
+	flagServerIDLabel     = flag.Bool("server-id-label", false, "Add a server_id label to the speed metric. This increases the metric cardinality when the server changes across runs")
+	flagMaxDirectionSkew  = flag.Float64("max-direction-skew", 0, "If greater than 1, flag runs whose download/upload ratio differs from the historical one by more than this factor. If 0, the check is disabled")
+	flagRetryOnSkew       = flag.Bool("retry-direction-anomaly", false, "Retry a run once when it is flagged by -max-direction-skew")
+	flagPostprocessScript = flag.String("postprocess-script", "", "Script that receives each successful result as JSON on stdin, and prints the result to export on stdout. If the script fails or doesn't exit within -t, the original result is used")
+	flagHost              = flag.String("host", "", "URL of a self-hosted Speedtest Mini server to run the speedtest against, instead of the public servers, e.g. http://192.168.1.10/speedtest/")
+	flagAnnotationsSize   = flag.Int("annotations-size", 100, "Maximum number of recent events served by the /annotations endpoint")
+	flagSamples           = flag.Int("samples", 1, "Number of back-to-back speedtests to run per cycle. The mean is exported, and the median is exported separately. Note that this multiplies the bandwidth consumption")
+	flagNoZeroOnError     = flag.Bool("no-zero-on-error", false, "On failure, remove the speed series and set the other result metrics to NaN instead of setting them to zero")
+	flagMQTTBroker        = flag.String("mqtt-broker", "", "If set, publish each result as JSON to this MQTT broker, e.g. tcp://localhost:1883")
+	flagMQTTTopic         = flag.String("mqtt-topic", "speedtest/result", "MQTT topic to publish results to")
+	flagMQTTClientID      = flag.String("mqtt-client-id", "prometheus-speedtest-exporter", "MQTT client ID")
+	flagMQTTUsername      = flag.String("mqtt-username", "", "MQTT username")
+	flagMQTTPassword      = flag.String("mqtt-password", "", "MQTT password")
+	flagRoundTo           = flag.Float64("round-to", 0, "If greater than 0, round the exported download and upload speeds to the nearest multiple of this value in bits per second, e.g. 1e6 for Mbps")
+	flagRoundSigFigs      = flag.Int("round-sig-figs", 0, "If greater than 0, round the exported download and upload speeds to this number of significant figures")
+	flagErrorGraceCount   = flag.Int("error-grace-count", 0, "Number of consecutive failures during which the last good result keeps being exported, before the metrics are reset")
+	flagAdminToken        = flag.String("admin-token", "", "Bearer token required by the POST /reset endpoint. If empty, the endpoint is disabled")
+	flagServerListIntvl   = flag.Duration("server-list-interval", 0, "How often to re-fetch the server list when filtering or ranking servers, expressed as a Go duration string. The list is cached between refreshes. If 0, it is fetched before every run")
+	flagAuditLog          = flag.String("audit-log", "", "If set, append one JSON line per run to this file, with the timestamp, server, result, retries and backend")
+	flagAuditLogFsync     = flag.Bool("audit-log-fsync", false, "Sync the audit log to disk after each record")
+	flagSLADownloadBits   = flag.Float64("sla-download-bits", 0, "Minimum download speed guaranteed by the ISP, in bits per second. Slower results are reported by speedtest_sla_breach. If 0, the download speed is not checked")
+	flagSLAPingMsec       = flag.Float64("sla-ping-msec", 0, "Maximum ping latency guaranteed by the ISP, in milliseconds. Slower results are reported by speedtest_sla_breach. If 0, the ping is not checked")
+	flagFieldMap          = flag.String("field-map", "", "JSON file mapping result fields (e.g. download, server.host) to dot-separated paths in the speedtest CLI output, for CLI versions whose output differs from speedtest-cli's. Unmapped fields are parsed as usual")
+	flagSettleTime        = flag.Duration("settle-time", 0, "If greater than 0, wait this long after -settle-interface comes up before running a speedtest, e.g. to let PPPoE or DHCP complete after a reboot. Only supported on Linux")
+	flagSettleInterface   = flag.String("settle-interface", "", "Network interface whose state is watched by -settle-time. Defaults to -bind-interface")
+	flagQualityWeights    = flag.String("quality-weights", "", "Comma-separated name=weight pairs overriding the weights used for speedtest_connection_quality_score. Valid names are download, upload, ping, jitter and loss; weights default to 1")
+	flagQualityTargets    = flag.String("quality-targets", "", "Comma-separated name=value pairs overriding the values at which each component of speedtest_connection_quality_score gets the full score. Defaults to download=100e6,upload=20e6,ping=20,jitter=5,loss=5, in bits per second, milliseconds and percent")
+	flagVPNInterface      = flag.String("vpn-interface", "", "If set together with -wan-interface, also run one speedtest bound to each interface every cycle, exported with path=\"vpn\" and path=\"wan\" labels, to measure the VPN overhead")
+	flagWANInterface      = flag.String("wan-interface", "", "Physical WAN interface compared to -vpn-interface")
+	flagConnRetries       = flag.Int("connection-retries", 3, "Number of times a run that fails because of a connection or DNS resolution error is retried after -connection-retry-interval, before it is considered failed")
+	flagConnRetryInterval = flag.Duration("connection-retry-interval", 10*time.Second, "Time to wait before retrying a run that failed because of a connection or DNS resolution error, expressed as a Go duration string")
+	flagCompareSecure     = flag.Bool("compare-secure", false, "Also run one speedtest with --secure and one without every cycle, exported with secure=\"true\" and secure=\"false\" labels, to measure the HTTPS overhead. Incompatible with server selection flags")
+	flagRandomStuckRuns   = flag.Int("random-stuck-runs", 5, "When no server is selected, warn and set speedtest_random_server_stuck if this many consecutive runs used the same server. If 0, the check is disabled")
+	flagBackgroundLoop    = flag.Bool("background-loop", true, "Run speedtests periodically in the background. Disable it to only run speedtests via the /probe endpoint, with Prometheus controlling the interval. The /probe endpoint is only served when the background loop is disabled")
+	flagNamespace         = flag.String("namespace", "speedtest", "Prefix of the exported metric names, e.g. isp_probe_speedtest for isp_probe_speedtest_ping_msec")
+	flagVersion           = flag.Bool("version", false, "Print the version and exit")
+	flagHealthzMaxAge     = flag.Duration("healthz-max-age", 0, "If greater than 0, /healthz responds with 503 when the last successful speedtest is older than this, expressed as a Go duration string")
+	flagMaxRetryInterval  = flag.Duration("max-retry-interval", 30*time.Minute, "Maximum interval between retries after repeated retryable HTTP errors, e.g. 403 or 503. The interval starts at one minute and doubles at every consecutive error, expressed as a Go duration string")
+	flagMaxRetries        = flag.Int("max-retries", 0, "Maximum number of consecutive retries after retryable HTTP errors. When reached, the metrics are reset and the next run is attempted after -i. If 0, retries are unlimited, except with -oneshot where they are limited to 3")
+	flagJitter            = flag.Duration("jitter", 0, "If greater than 0, randomize each interval between speedtests by up to this amount in either direction, so that exporters started together don't probe at the same time, expressed as a Go duration string")
+	flagRunOnStart        = flag.Bool("run-on-start", true, "Run the first speedtest right after startup. If false, wait for -i or for a /run request first")
+	flagBindInterface     = flag.String("bind-interface", "", "Network interface to run the speedtest from. Its address is resolved before each run and passed to speedtest-cli via --source")
+	flagTLSCert           = flag.String("tls-cert", "", "TLS certificate file. If set together with -tls-key, the metrics are served over HTTPS")
+	flagTLSKey            = flag.String("tls-key", "", "TLS private key file, see -tls-cert")
+	flagAuthUser          = flag.String("auth-user", "", "If set together with -auth-pass, require HTTP Basic authentication for all the endpoints but /healthz, and /reset which uses -admin-token")
+	flagAuthPass          = flag.String("auth-pass", "", "Password for HTTP Basic authentication, see -auth-user")
+	flagCacheTTL          = flag.Duration("cache-ttl", 0, "If greater than 0, /probe serves the last successful result instead of running a speedtest as long as it is younger than this, expressed as a Go duration string")
+	flagSelect            = flag.String("select", "cli", "How to select the server among the filtered candidates: cli passes all of them to speedtest-cli at every run, latency runs a latency test first and only uses the lowest-latency one")
+	flagPinServer         = flag.Bool("pin-server", false, "When filtering servers, select a single server once (the closest, unless -server-rank or -select say otherwise) and keep using it across runs, so that results are comparable")
+	flagListServers       = flag.Bool("list-servers", false, "Print the servers that pass the -R, -m, -country and -exclude-zero-distance filters, and exit without running any speedtest")
+	flagCountry           = flag.String("country", "", "Only use servers in this country, as named by 'speedtest-cli --list' (e.g. Italy), case-insensitive")
+	flagSourceIP          = flag.String("source-ip", "", "Source address to run the speedtest from, passed to speedtest-cli via --source. Alternative to -bind-interface, e.g. to select a WAN on a multi-homed host")
+	flagPreHook           = flag.String("pre-hook", "", "Shell command to run before each speedtest, e.g. to switch a routing table. Failures are logged but don't abort the run")
+	flagPostHook          = flag.String("post-hook", "", "Shell command to run after each speedtest. The outcome is passed in the SPEEDTEST_SUCCESS, SPEEDTEST_ERROR, SPEEDTEST_DOWNLOAD, SPEEDTEST_UPLOAD, SPEEDTEST_PING and SPEEDTEST_SERVER_ID environment variables. Failures are logged")
+	flagLastJSON          = flag.Bool("last-json", false, "Serve the last successful result and the raw speedtest CLI output at /last.json, for troubleshooting")
+	flagPushgateway       = flag.String("pushgateway", "", "If set, push the metrics to this Prometheus Pushgateway after each run, e.g. http://pushgateway:9091, for probes that can't be scraped")
+	flagPushgatewayJob    = flag.String("pushgateway-job", "speedtest", "Job name used when pushing to -pushgateway")
+	flagPushgatewayInst   = flag.String("pushgateway-instance", "", "Value of the instance grouping label used when pushing to -pushgateway. Defaults to the host name")
+	flagOneshot           = flag.Bool("oneshot", false, "Run a single speedtest, print the metrics on stdout (or write them to -textfile-out) and exit, with a non-zero exit code on failure. Useful to run the exporter from cron")
+	flagBackend           = flag.String("backend", "cli", "Speedtest backend: cli runs the speedtest CLI set with -s, go uses the built-in speedtest-go library and doesn't need any external program")
+	flagConfig            = flag.String("config", "", "YAML configuration file setting the listen address, metrics path, CLI path, server ID, intervals, max distance and server regexp. Flags passed on the command line take precedence")
 )
 
-var errRetryable403 = fmt.Errorf("speedtest temporarily failed for HTTP 403, try again later")
+var errRetryable = fmt.Errorf("speedtest temporarily failed, try again later")
+
+var errConnection = errors.New("speedtest failed to connect")
+
+var errTimeout = errors.New("speedtest CLI timed out")
+
+var errBusy = errors.New("another speedtest is running")
 
 const defaultRetryInterval = 60 * time.Second
 
+// oneshotMaxRetries replaces the unlimited -max-retries with -oneshot, so that
+// a run from cron doesn't overlap the next one.
+const oneshotMaxRetries = 3
+
+// shutdownTimeout is how long to wait for the in-flight HTTP requests and
+// commands to complete on shutdown.
+const shutdownTimeout = 10 * time.Second
+
 type speedTestResult struct {
 	Download      float64
 	Upload        float64
 	Ping          float64
 	Timestamp     time.Time
-	BytesSent     uint
-	BytesReceived uint
+	BytesSent     uint `json:"bytes_sent"`
+	BytesReceived uint `json:"bytes_received"`
 	Client        clientInfo
 	Server        serverInfo
+	// Jitter in milliseconds and PacketLoss as a ratio between 0 and 1 are
+	// not reported by speedtest-cli, and are nil unless a backend or a
+	// -field-map provides them.
+	Jitter     *float64 `json:"jitter,omitempty"`
+	PacketLoss *float64 `json:"packet_loss,omitempty"`
+
+	// Interface is the network interface the test was bound to, if any. It
+	// is not part of the speedtest-cli output.
+	Interface string `json:"-"`
+	// Retries is the number of retryable failures before this result was
+	// obtained.
+	Retries int `json:"-"`
+	// Duration is how long the speedtest CLI took to run.
+	Duration time.Duration `json:"-"`
+	// Started is when the speedtest was started, according to the
+	// exporter's clock.
+	Started time.Time `json:"-"`
+	// Stderr is what the speedtest CLI printed on standard error, if
+	// anything. Some versions print warnings there even on success.
+	Stderr string `json:"-"`
+	// Raw is the JSON output of the speedtest CLI, as is.
+	Raw json.RawMessage `json:"-"`
 }
 
 type clientInfo struct {
@@ -75,57 +203,121 @@ type serverInfo struct {
 	Latency float64
 }
 
-func speedtest(cliPath string, serverIDs []int, insecure bool) (*speedTestResult, error) {
+// cliMu ensures that only one speedtest runs at a time, so that concurrent
+// runs don't compete for bandwidth and corrupt each other's results.
+var cliMu sync.Mutex
+
+// speedtestOptions are the options of a speedtest run.
+type speedtestOptions struct {
+	// serverIDs are the candidate servers. If empty, speedtest-cli picks one.
+	serverIDs []int
+	insecure  bool
+	// sourceIP is the address to bind to, if not nil.
+	sourceIP net.IP
+	// pingOnly skips the download and upload tests.
+	pingOnly bool
+	// miniURL is the URL of a self-hosted Speedtest Mini server. If set, it
+	// is used instead of the public servers.
+	miniURL string
+	// fieldMap overrides the fields parsed from the CLI output, if not empty.
+	fieldMap fieldMap
+	// timeout is the maximum duration of the run. If 0, there is no timeout.
+	timeout time.Duration
+	// noWait makes speedtest fail with errBusy instead of waiting if another
+	// speedtest is running.
+	noWait bool
+}
+
+// cliContext returns the context to run the speedtest CLI with the given
+// timeout. If timeout is 0, the context has no deadline.
+func cliContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// speedtest runs the speedtest CLI. The CLI is killed when ctx is done.
+func speedtest(ctx context.Context, cliPath string, opts speedtestOptions) (*speedTestResult, error) {
+	if opts.noWait {
+		if !cliMu.TryLock() {
+			return nil, errBusy
+		}
+	} else {
+		cliMu.Lock()
+	}
+	defer cliMu.Unlock()
+	if *flagBackend == "go" {
+		return goSpeedtest(ctx, opts)
+	}
+	started := time.Now()
 	args := []string{"--json"}
+	if opts.pingOnly {
+		args = append(args, "--no-download", "--no-upload")
+	}
+	if opts.sourceIP != nil {
+		args = append(args, "--source", opts.sourceIP.String())
+	}
+	if opts.miniURL != "" {
+		args = append(args, "--mini", opts.miniURL)
+	}
 	usingServerIDs := false
-	for _, serverID := range serverIDs {
+	for _, serverID := range opts.serverIDs {
 		if serverID != 0 {
 			args = append(args, "--server", fmt.Sprintf("%d", serverID))
 			usingServerIDs = true
 		}
 	}
-	if !insecure {
+	if !opts.insecure {
 		if usingServerIDs {
 			logrus.Warningf("Disabling --secure because it is apparently incompatible with a custom list of servers")
 		} else {
 			args = append(args, "--secure")
 		}
 	}
-	cmd := exec.Command(cliPath, args...)
+	ctx, cancel := cliContext(ctx, opts.timeout)
+	defer cancel()
+	cmd := commandContext(ctx, cliPath, args...)
 	var outb, errb bytes.Buffer
 	cmd.Stdout = &outb
 	cmd.Stderr = &errb
 	logrus.Debugf("Executing command %+v", cmd)
-	if runErr := cmd.Run(); runErr != nil {
-		var (
-			errCode int
-			errMsg  string
-		)
-		errstr := errb.String()
-		outstr := outb.String()
-		scanner := bufio.NewScanner(&errb)
-		for scanner.Scan() {
-			n, err := fmt.Fscanf(strings.NewReader(scanner.Text()), "ERROR: HTTP Error %d: %s\n", &errCode, &errMsg)
-			if err != nil || n != 2 {
-				// not an HTTP error string, ignore
-				continue
-			}
-			// at this point we know there's an HTTP error. If it's 403
-			// Forbidden we know something's being updated on the SpeedTest
-			// side, so we can wait and retry
-			if errCode == 403 {
-				return nil, errRetryable403
-			}
+	if runErr := runCommand(cmd); runErr != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w after %s", errTimeout, opts.timeout)
+		} else if ctx.Err() != nil {
+			return nil, fmt.Errorf("speedtest CLI interrupted: %w", ctx.Err())
 		}
-		if err := scanner.Err(); err != nil {
-			logrus.Warning("Text scanner failed: %w", err)
+		if err := retryableCLIError(errb.String()); err != nil {
+			return nil, err
 		}
-		return nil, fmt.Errorf("failed to execute speedtest CLI: %w\nStdout: %s\nStderr: %s", runErr, outstr, errstr)
+		return nil, fmt.Errorf("failed to execute speedtest CLI: %w\nStdout: %s\nStderr: %s", runErr, outb.String(), errb.String())
 	}
 	logrus.Debugf("Raw output: %s", outb.String())
 	var ret speedTestResult
 	if err := json.Unmarshal(outb.Bytes(), &ret); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal JSON result: %w", err)
+		// mapped fields may have a different type than the built-in ones
+		var typeErr *json.UnmarshalTypeError
+		if len(opts.fieldMap) == 0 || !errors.As(err, &typeErr) {
+			return nil, fmt.Errorf("failed to unmarshal JSON result: %w", err)
+		}
+	}
+	if len(opts.fieldMap) > 0 {
+		if err := opts.fieldMap.apply(outb.Bytes(), &ret); err != nil {
+			return nil, fmt.Errorf("failed to apply field map: %w", err)
+		}
+	}
+	ret.Raw = json.RawMessage(outb.Bytes())
+	ret.Started = started
+	if stderr := strings.TrimSpace(errb.String()); stderr != "" {
+		logrus.Warningf("Speedtest CLI succeeded but printed to stderr: %s", stderr)
+		ret.Stderr = stderr
+	}
+	if opts.miniURL != "" && ret.Server.Host == "" {
+		// speedtest-cli doesn't report the host of Speedtest Mini servers
+		if u, err := url.Parse(opts.miniURL); err == nil {
+			ret.Server.Host = u.Host
+		}
 	}
 	logrus.Debugf("Speedtest results: %+v", ret)
 	return &ret, nil
@@ -134,51 +326,59 @@ func speedtest(cliPath string, serverIDs []int, insecure bool) (*speedTestResult
 type SpeedtestServer struct {
 	ID         int
 	Name       string
-	DistanceKm int
+	DistanceKm float64
+	// Country is the country name at the end of Name, if any
+	Country string
 }
 
-var serverListRegexp = regexp.MustCompile(`(\d+)\) (.+) [[](\d+\.\d+) km[]]`)
+// serverListRegexp matches a line of `speedtest-cli --list`. It is anchored on
+// the final " [123.4 km]" segment, since server names can contain brackets.
+// Some versions print whole-number distances, e.g. " [12 km]".
+var serverListRegexp = regexp.MustCompile(`^\s*(\d+)\) (.+) \[(\d+(?:\.\d+)?) km\]\s*$`)
+
+// serverCountryRegexp matches the "(City, Country)" suffix of the server names
+// printed by `speedtest-cli --list`.
+var serverCountryRegexp = regexp.MustCompile(`\([^()]*, ([^,()]+)\)$`)
 
-func getServers(cliPath string, insecure bool) ([]SpeedtestServer, error) {
+func getServers(ctx context.Context, cliPath string, insecure bool, sourceIP net.IP, timeout time.Duration) ([]SpeedtestServer, error) {
+	if *flagBackend == "go" {
+		return goServers(ctx, sourceIP, timeout)
+	}
 	args := []string{"--list"}
+	if sourceIP != nil {
+		args = append(args, "--source", sourceIP.String())
+	}
 	if !insecure {
 		args = append(args, "--secure")
 	}
-	cmd := exec.Command(cliPath, args...)
+	ctx, cancel := cliContext(ctx, timeout)
+	defer cancel()
+	cmd := commandContext(ctx, cliPath, args...)
 	var outb, errb bytes.Buffer
 	cmd.Stdout = &outb
 	cmd.Stderr = &errb
 	logrus.Debugf("Executing command %+v", cmd)
-	if runErr := cmd.Run(); runErr != nil {
-		var (
-			errCode int
-			errMsg  string
-		)
-		errstr := errb.String()
-		outstr := outb.String()
-		scanner := bufio.NewScanner(&errb)
-		for scanner.Scan() {
-			n, err := fmt.Fscanf(strings.NewReader(scanner.Text()), "ERROR: HTTP Error %d: %s\n", &errCode, &errMsg)
-			if err != nil || n != 2 {
-				// not an HTTP error string, ignore
-				continue
-			}
-			// at this point we know there's an HTTP error. If it's 403
-			// Forbidden we know something's being updated on the SpeedTest
-			// side, so we can wait and retry
-			if errCode == 403 {
-				return nil, errRetryable403
-			}
+	if runErr := runCommand(cmd); runErr != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w after %s", errTimeout, timeout)
+		} else if ctx.Err() != nil {
+			return nil, fmt.Errorf("speedtest CLI interrupted: %w", ctx.Err())
 		}
-		if err := scanner.Err(); err != nil {
-			logrus.Warning("Text scanner failed: %w", err)
+		if err := retryableCLIError(errb.String()); err != nil {
+			return nil, err
 		}
-		return nil, fmt.Errorf("failed to get speedtest's closest servers list: %w\nStdout: %s\nStderr: %s", runErr, outstr, errstr)
+		return nil, fmt.Errorf("failed to get speedtest's closest servers list: %w\nStdout: %s\nStderr: %s", runErr, outb.String(), errb.String())
 	}
-	scanner := bufio.NewScanner(&outb)
+	return parseServerList(&outb)
+}
+
+// parseServerList parses the output of `speedtest-cli --list`, skipping the
+// lines that don't describe a server.
+func parseServerList(r io.Reader) ([]SpeedtestServer, error) {
+	scanner := bufio.NewScanner(r)
 	servers := make([]SpeedtestServer, 0)
 	for scanner.Scan() {
-		// parse output line. The format is "ServerID) Server Name [123.4 km]
+		// parse output line. The format is "ServerID) Server Name [123.4 km]"
 		line := scanner.Text()
 		logrus.Debugf("Server list line: %s", line)
 		matches := serverListRegexp.FindStringSubmatch(line)
@@ -192,12 +392,13 @@ func getServers(cliPath string, insecure bool) ([]SpeedtestServer, error) {
 		}
 		distanceKm, err := strconv.ParseFloat(matches[3], 64)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse integer string %q: %v", matches[3], err)
+			return nil, fmt.Errorf("failed to parse distance %q: %v", matches[3], err)
 		}
 		servers = append(servers, SpeedtestServer{
 			ID:         int(serverID),
 			Name:       matches[2],
-			DistanceKm: int(distanceKm),
+			DistanceKm: distanceKm,
+			Country:    serverCountry(matches[2]),
 		})
 	}
 	if len(servers) == 0 {
@@ -206,49 +407,246 @@ func getServers(cliPath string, insecure bool) ([]SpeedtestServer, error) {
 	return servers, nil
 }
 
-func setError(speedtestSpeedGauge prometheus.GaugeVec, speedtestPingGauge prometheus.Gauge) {
-	// update value
-	speedtestSpeedGauge.Reset()
-	speedtestSpeedGauge.WithLabelValues(
-		"upload",
-		// client ip, client isp, client country
-		"", "", "",
-		// server sponsor, server host, server country
-		"", "", "",
-	).Set(0)
-	speedtestSpeedGauge.WithLabelValues(
-		"download",
-		// client ip, client isp, client country
-		"", "", "",
-		// server sponsor, server host, server country
-		"", "", "",
-	).Set(0)
-	speedtestPingGauge.Set(0)
+// serverCountry returns the country of a server given its name as printed by
+// `speedtest-cli --list`, or an empty string if it can't be found.
+func serverCountry(name string) string {
+	matches := serverCountryRegexp.FindStringSubmatch(name)
+	if matches == nil {
+		return ""
+	}
+	return strings.TrimSpace(matches[1])
+}
+
+// sourceAddress returns the address to run the speedtest from: the one set
+// with -source-ip, or the address of -bind-interface, which is resolved at
+// every call since it can change. It returns nil if neither is set.
+func sourceAddress() (net.IP, error) {
+	if *flagSourceIP != "" {
+		return net.ParseIP(*flagSourceIP), nil
+	}
+	if *flagBindInterface != "" {
+		ip, err := interfaceIP(*flagBindInterface)
+		if err != nil {
+			return nil, err
+		}
+		return ip, nil
+	}
+	return nil, nil
+}
+
+// interfaceIP returns the first usable IP address of the given network
+// interface, preferring IPv4 addresses.
+func interfaceIP(name string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get interface %q: %w", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get addresses of interface %q: %w", name, err)
+	}
+	var ip6 net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || !ipnet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP, nil
+		}
+		if ip6 == nil {
+			ip6 = ipnet.IP
+		}
+	}
+	if ip6 != nil {
+		return ip6, nil
+	}
+	return nil, fmt.Errorf("no usable address found on interface %q", name)
+}
+
+// fetchServerID gets a server ID from the given URL. The response body can be
+// either a plain-text integer, a JSON number or string, or a JSON object with
+// an "id" or "server_id" field.
+func fetchServerID(url string) (int, error) {
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, fmt.Errorf("HTTP request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected HTTP status %q", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read response body: %w", err)
+	}
+	body = bytes.TrimSpace(body)
+	if id, err := strconv.Atoi(string(body)); err == nil {
+		return id, nil
+	}
+	var obj struct {
+		ID       json.Number `json:"id"`
+		ServerID json.Number `json:"server_id"`
+	}
+	var str string
+	switch {
+	case json.Unmarshal(body, &str) == nil:
+		obj.ID = json.Number(str)
+	case json.Unmarshal(body, &obj) == nil:
+		if obj.ID == "" {
+			obj.ID = obj.ServerID
+		}
+	default:
+		return 0, fmt.Errorf("response is neither an integer nor valid JSON: %q", body)
+	}
+	id, err := strconv.Atoi(obj.ID.String())
+	if err != nil {
+		return 0, fmt.Errorf("invalid server ID %q: %w", obj.ID, err)
+	}
+	return id, nil
+}
+
+// listServers prints the servers of the server list that pass the given
+// filters.
+func listServers(ctx context.Context, filters serverFilters) error {
+	sourceIP, err := sourceAddress()
+	if err != nil {
+		return err
+	}
+	servers, err := getServers(ctx, *flagSpeedTestCLI, *flagInsecure, sourceIP, *flagTimeout)
+	if err != nil {
+		return err
+	}
+	for _, s := range filters.filter(servers) {
+		fmt.Printf("%5d) %s [%.2f km]\n", s.ID, s.Name, s.DistanceKm)
+	}
+	return nil
+}
+
+// jitteredInterval returns interval randomized by up to jitter in either
+// direction.
+func jitteredInterval(interval, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return interval - jitter + time.Duration(rand.Int63n(int64(2*jitter)+1))
+}
+
+// validateIntervals checks that the interval flags have sane values. A zero or
+// negative interval would make the loop spin and hammer the speedtest servers.
+func validateIntervals() error {
+	for _, f := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"-i", *flagSleepInterval},
+		{"-r", *flagRetryInterval},
+	} {
+		if f.value <= 0 {
+			return fmt.Errorf("%s must be a positive duration, got %s", f.name, f.value)
+		}
+	}
+	if *flagJitter < 0 || *flagJitter >= *flagSleepInterval {
+		return fmt.Errorf("-jitter must be between 0 and -i, got %s", *flagJitter)
+	}
+	if *flagTimeout < 0 {
+		return fmt.Errorf("-t cannot be negative, got %s", *flagTimeout)
+	}
+	if *flagPingInterval < 0 {
+		return fmt.Errorf("-ping-interval cannot be negative, got %s", *flagPingInterval)
+	}
+	if *flagConnRetries < 0 {
+		return fmt.Errorf("-connection-retries cannot be negative, got %d", *flagConnRetries)
+	}
+	if *flagConnRetryInterval <= 0 {
+		return fmt.Errorf("-connection-retry-interval must be a positive duration, got %s", *flagConnRetryInterval)
+	}
+	if *flagMaxRetryInterval < defaultRetryInterval {
+		return fmt.Errorf("-max-retry-interval must be at least %s, got %s", defaultRetryInterval, *flagMaxRetryInterval)
+	}
+	if *flagSettleTime < 0 {
+		return fmt.Errorf("-settle-time cannot be negative, got %s", *flagSettleTime)
+	}
+	if *flagHealthzMaxAge < 0 {
+		return fmt.Errorf("-healthz-max-age cannot be negative, got %s", *flagHealthzMaxAge)
+	}
+	if *flagCacheTTL < 0 {
+		return fmt.Errorf("-cache-ttl cannot be negative, got %s", *flagCacheTTL)
+	}
+	if *flagServerListIntvl < 0 {
+		return fmt.Errorf("-server-list-interval cannot be negative, got %s", *flagServerListIntvl)
+	}
+	return nil
 }
 
 func main() {
 	flag.Parse()
-	logrus.SetLevel(logrus.InfoLevel)
+	if *flagVersion {
+		fmt.Println(versionString())
+		return
+	}
+	// flags take precedence over environment variables, which take
+	// precedence over the configuration file
+	setFlags := commandLineFlags()
+	if err := applyFlagValues(envFlagValues(), setFlags); err != nil {
+		logrus.Fatalf("Invalid environment variable: %v", err)
+	}
+	if *flagConfig != "" {
+		cfg, err := loadConfig(*flagConfig)
+		if err != nil {
+			logrus.Fatalf("Failed to load configuration: %v", err)
+		}
+		if err := applyFlagValues(cfg.flagValues(), setFlags); err != nil {
+			logrus.Fatalf("Invalid configuration file %s: %v", *flagConfig, err)
+		}
+	}
+	level, err := logrus.ParseLevel(*flagLogLevel)
+	if err != nil {
+		logrus.Fatalf("Invalid -log-level: %v", err)
+	}
 	if *flagDebug {
-		logrus.SetLevel(logrus.DebugLevel)
-	}
-
-	speedtestSpeedGauge := prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "speedtest_speed_bits_per_second",
-			Help: "SpeedTest.net upload and download speed",
-		},
-		[]string{"direction", "client_ip", "client_isp", "client_country", "server_sponsor", "server_host", "server_country"},
-	)
-	speedtestPingGauge := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "speedtest_ping_msec",
-		Help: "SpeedTest.net ping latency in milliseconds",
-	})
-	if err := prometheus.Register(speedtestSpeedGauge); err != nil {
-		logrus.Fatalf("Failed to register speedtest speed gauge: %v", err)
-	}
-	if err := prometheus.Register(speedtestPingGauge); err != nil {
-		logrus.Fatalf("Failed to register speedtest ping gauge: %v", err)
+		level = logrus.DebugLevel
+	}
+	logrus.SetLevel(level)
+	switch *flagLogFormat {
+	case "text":
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		logrus.Fatalf("Invalid -log-format %q, must be text or json", *flagLogFormat)
+	}
+	if err := validateIntervals(); err != nil {
+		logrus.Fatalf("Invalid flags: %v", err)
+	}
+	// ctx is done on shutdown, and kills the running speedtests
+	ctx, stop := signal.NotifyContext(context.Background(), shutdownSignals...)
+	defer stop()
+
+	speedLabels, err := parseSpeedLabels(*flagLabels)
+	if err != nil {
+		logrus.Fatalf("Invalid -labels: %v", err)
+	}
+	if *flagServerIDLabel {
+		speedLabels = append(speedLabels, "server_id")
+	}
+	// the speedtest metrics live in their own registry, so that they can be
+	// exported on their own, without the Go runtime and process metrics.
+	newRegistry := func() (*metrics, *prometheus.Registry, error) {
+		m := newMetrics(*flagNamespace, speedLabels)
+		m.noZeroOnError = *flagNoZeroOnError
+		m.roundTo = *flagRoundTo
+		m.roundSigFigs = *flagRoundSigFigs
+		reg := prometheus.NewRegistry()
+		if err := m.register(reg, parseMetricNames(*flagEnableMetrics), parseMetricNames(*flagDisableMetrics)); err != nil {
+			return nil, nil, err
+		}
+		return m, reg, nil
+	}
+	logrus.Infof("Starting %s", versionString())
+	m, reg, err := newRegistry()
+	if err != nil {
+		logrus.Fatalf("Failed to register metrics: %v", err)
 	}
 	var serverRegexp *regexp.Regexp
 	if *flagServerRegexp != "" {
@@ -258,101 +656,836 @@ func main() {
 		}
 		serverRegexp = rx
 	}
+	confidenceWeights, err := parseConfidenceWeights(*flagConfidenceWeights)
+	if err != nil {
+		logrus.Fatalf("Failed to parse confidence weights: %v", err)
+	}
+	qualityWeights, err := parseQualityValues(*flagQualityWeights, defaultQualityWeights)
+	if err != nil {
+		logrus.Fatalf("Failed to parse quality weights: %v", err)
+	}
+	qualityTargets, err := parseQualityValues(*flagQualityTargets, defaultQualityTargets)
+	if err != nil {
+		logrus.Fatalf("Failed to parse quality targets: %v", err)
+	}
+	for _, target := range []float64{qualityTargets.Download, qualityTargets.Upload, qualityTargets.Ping, qualityTargets.Jitter, qualityTargets.Loss} {
+		if target == 0 {
+			logrus.Fatalf("Quality targets must be greater than 0")
+		}
+	}
 
-	go func() {
+	maintenanceWindows, err := parseTimeWindows(*flagMaintenance)
+	if err != nil {
+		logrus.Fatalf("Failed to parse maintenance windows: %v", err)
+	}
+
+	if *flagMaxPendingRuns < 0 {
+		logrus.Fatalf("-max-pending-runs cannot be negative")
+	}
+	runRequests := make(chan struct{}, *flagMaxPendingRuns)
+	baseline, err := loadBaseline(*flagBaselineFile)
+	if err != nil {
+		logrus.Fatalf("Failed to load baseline: %v", err)
+	}
+	results := m.results
+	events := newEventLog(*flagAnnotationsSize)
+	var audit *auditLog
+	if *flagAuditLog != "" {
+		audit, err = newAuditLog(*flagAuditLog, *flagAuditLogFsync)
+		if err != nil {
+			logrus.Fatalf("Failed to set up audit log: %v", err)
+		}
+	}
+	if !backends[*flagBackend] {
+		logrus.Fatalf("Invalid -backend %q, must be cli or go", *flagBackend)
+	}
+	backend := "speedtest-cli"
+	if *flagBackend == "go" {
+		backend = "speedtest-go"
+	} else if *flagHost != "" {
+		backend = "speedtest-mini"
+	}
+	var publisher *mqttPublisher
+	if *flagMQTTBroker != "" {
+		publisher, err = newMQTTPublisher(*flagMQTTBroker, *flagMQTTTopic, *flagMQTTClientID, *flagMQTTUsername, *flagMQTTPassword)
+		if err != nil {
+			logrus.Fatalf("Failed to set up MQTT: %v", err)
+		}
+	}
+
+	var pusher *push.Pusher
+	if *flagPushgateway != "" {
+		instance := *flagPushgatewayInst
+		if instance == "" {
+			if instance, err = os.Hostname(); err != nil {
+				logrus.Fatalf("Failed to get host name, use -pushgateway-instance: %v", err)
+			}
+		}
+		pusher = push.New(*flagPushgateway, *flagPushgatewayJob).Gatherer(reg).Grouping("instance", instance)
+		logrus.Infof("Pushing metrics to %s with job %q and instance %q", *flagPushgateway, *flagPushgatewayJob, instance)
+	}
+
+	if *flagErrorGraceCount < 0 {
+		logrus.Fatalf("-error-grace-count cannot be negative")
+	}
+	if *flagRandomStuckRuns < 0 {
+		logrus.Fatalf("-random-stuck-runs cannot be negative")
+	}
+	if *flagMaxRetries < 0 {
+		logrus.Fatalf("-max-retries cannot be negative")
+	}
+	if *flagSamples < 1 {
+		logrus.Fatalf("-samples must be at least 1")
+	}
+	// node_exporter's textfile collector ignores the other files
+	if *flagTextfileOut != "" && filepath.Ext(*flagTextfileOut) != ".prom" {
+		logrus.Fatalf("-textfile-out must end in .prom, got %q", *flagTextfileOut)
+	}
+	if *flagServerRank < 0 {
+		logrus.Fatalf("-server-rank cannot be negative")
+	}
+	if !serverSelections[*flagSelect] {
+		logrus.Fatalf("Invalid -select %q, must be cli or latency", *flagSelect)
+	}
+	if *flagSelect == "latency" && *flagServerRank > 0 {
+		logrus.Fatalf("-select latency cannot be used with -server-rank")
+	}
+	if *flagMaxDirectionSkew != 0 && *flagMaxDirectionSkew <= 1 {
+		logrus.Fatalf("-max-direction-skew must be greater than 1, got %f", *flagMaxDirectionSkew)
+	}
+	var skew directionSkew
+	var fieldMap fieldMap
+	if *flagFieldMap != "" && *flagBackend == "go" {
+		logrus.Fatalf("-field-map can only be used with -backend cli")
+	}
+	if *flagFieldMap != "" {
+		fieldMap, err = loadFieldMap(*flagFieldMap)
+		if err != nil {
+			logrus.Fatalf("Failed to load field map: %v", err)
+		}
+	}
+	if *flagSLADownloadBits < 0 || *flagSLAPingMsec < 0 {
+		logrus.Fatalf("-sla-download-bits and -sla-ping-msec cannot be negative")
+	}
+	sla := slaThresholds{DownloadBits: *flagSLADownloadBits, PingMsec: *flagSLAPingMsec}
+	m.setFilterInfo(*flagServerRegexp, *flagMaxDistance, *flagExcludeZeroDist, *flagServerRank, *flagCountry)
+	// the server list is only needed if we have to filter or rank servers
+	useServerList := *flagServerRegexp != "" || *flagMaxDistance != 0 || *flagExcludeZeroDist || *flagServerRank > 0 || *flagCountry != ""
+	if *flagHost != "" && (useServerList || *flagSpeedTestServerID != 0 || *flagServerIDURL != "") {
+		logrus.Warningf("Using server %s, server selection flags are ignored", *flagHost)
+	}
+
+	filters := serverFilters{
+		regexp:              serverRegexp,
+		maxDistanceKm:       *flagMaxDistance,
+		excludeZeroDistance: *flagExcludeZeroDist,
+		country:             *flagCountry,
+	}
+	if *flagPinServer && !useServerList {
+		logrus.Warningf("-pin-server has no effect without server filtering flags, use -S to select a server")
+	}
+	if *flagCompareSecure && *flagBackend == "go" {
+		logrus.Fatalf("-compare-secure can only be used with -backend cli")
+	}
+	if *flagCompareSecure && (useServerList || *flagSpeedTestServerID != 0 || *flagServerIDURL != "") {
+		logrus.Fatalf("-compare-secure cannot be used with server selection flags, since --secure is disabled when servers are selected")
+	}
+	// urlServerID is read by the background loop and by /probe
+	var urlServerID serverIDStore
+	if *flagServerIDURL != "" {
+		id, err := fetchServerID(*flagServerIDURL)
+		if err != nil {
+			logrus.Warningf("Failed to fetch server ID from %s, falling back to %d: %v", *flagServerIDURL, *flagSpeedTestServerID, err)
+		} else {
+			logrus.Infof("Fetched server ID %d from %s", id, *flagServerIDURL)
+			urlServerID.set(id)
+		}
+	}
+	// selectedServerID returns the server ID from -server-id-url, fetched
+	// again if -server-id-refresh is set, or -S if there is none.
+	selectedServerID := func() int {
+		if *flagServerIDURL != "" && *flagServerIDRefresh {
+			id, err := fetchServerID(*flagServerIDURL)
+			if err != nil {
+				logrus.Warningf("Failed to fetch server ID from %s, using cached value: %v", *flagServerIDURL, err)
+			} else {
+				urlServerID.set(id)
+			}
+		}
+		if id := urlServerID.get(); id != 0 {
+			return id
+		}
+		return *flagSpeedTestServerID
+	}
+
+	if (*flagTLSCert == "") != (*flagTLSKey == "") {
+		logrus.Fatalf("-tls-cert and -tls-key must be used together")
+	}
+	if (*flagAuthUser == "") != (*flagAuthPass == "") {
+		logrus.Fatalf("-auth-user and -auth-pass must be used together")
+	}
+	// withAuth wraps the handlers of the endpoints protected by -auth-user
+	withAuth := func(h http.Handler) http.Handler {
+		if *flagAuthUser == "" {
+			return h
+		}
+		return basicAuth(*flagAuthUser, *flagAuthPass, h)
+	}
+	if *flagSourceIP != "" {
+		if net.ParseIP(*flagSourceIP) == nil {
+			logrus.Fatalf("Invalid -source-ip %q", *flagSourceIP)
+		}
+		if *flagBindInterface != "" {
+			logrus.Fatalf("-source-ip and -bind-interface cannot be used together")
+		}
+	}
+	var paths []testPath
+	if (*flagVPNInterface == "") != (*flagWANInterface == "") {
+		logrus.Fatalf("-vpn-interface and -wan-interface must be used together")
+	}
+	if *flagVPNInterface != "" {
+		paths = []testPath{{name: "wan", iface: *flagWANInterface}, {name: "vpn", iface: *flagVPNInterface}}
+	}
+	if *flagBackend == "go" {
+		logrus.Infof("Using the built-in speedtest-go backend, -s is ignored")
+	} else if path, err := exec.LookPath(*flagSpeedTestCLI); err != nil {
+		logrus.Fatalf("Speedtest CLI %q not found or not executable, use -s to set its path: %v", *flagSpeedTestCLI, err)
+	} else {
+		logrus.Infof("Using speedtest CLI %s", path)
+	}
+	if *flagListServers {
+		if err := listServers(ctx, filters); err != nil {
+			logrus.Fatalf("Failed to list servers: %v", err)
+		}
+		return
+	}
+	var cli *cliWatcher
+	if *flagBackend == "cli" {
+		m.setCLIVersion(*flagSpeedTestCLI)
+		cli = &cliWatcher{path: *flagSpeedTestCLI}
+	}
+	var link *linkWatcher
+	if *flagSettleTime > 0 {
+		iface := *flagSettleInterface
+		if iface == "" {
+			iface = *flagBindInterface
+		}
+		if iface == "" {
+			logrus.Fatalf("-settle-time requires -settle-interface or -bind-interface")
+		}
+		link = &linkWatcher{iface: iface, settle: *flagSettleTime}
+	}
+	// waitNextRun sleeps for the given duration, or until a run is requested
+	// via /run. It returns false if the exporter is shutting down.
+	waitNextRun := func(sleep time.Duration) bool {
+		logrus.Infof("Sleeping %s...", sleep)
+		select {
+		case <-ctx.Done():
+			logrus.Infof("Stopping the background loop")
+			return false
+		case <-time.After(sleep):
+		case <-runRequests:
+			m.pendingRuns.Set(float64(len(runRequests)))
+			logrus.Infof("Running speedtest on request")
+		}
+		return true
+	}
+	// oneshotErr is the outcome of the run, see -oneshot
+	var oneshotErr error
+	// giveUp records the error of the run and returns true if the loop must
+	// stop instead of retrying, see -oneshot
+	giveUp := func(err error) bool {
+		if !*flagOneshot {
+			return false
+		}
+		oneshotErr = err
+		return true
+	}
+	maxRetries := *flagMaxRetries
+	if *flagOneshot && maxRetries == 0 {
+		maxRetries = oneshotMaxRetries
+	}
+	// resetPending is set by /reset, and tells the background loop to clear
+	// its state before the next run
+	var resetPending atomic.Bool
+	runLoop := func() {
+		if !*flagRunOnStart && !*flagOneshot && !waitNextRun(jitteredInterval(*flagSleepInterval, *flagJitter)) {
+			return
+		}
+		var (
+			retries        int
+			anomalyRetried bool
+			// connRetries counts the connection errors of the current
+			// cycle, see -connection-retries
+			connRetries int
+			// httpRetries counts the consecutive retryable HTTP errors, to back
+			// off exponentially, see -max-retry-interval
+			httpRetries int
+		)
+		// fail records a failed cycle. The metrics are reset only after more
+		// than -error-grace-count consecutive failures, so that brief blips
+		// don't publish zeros.
+		consecutiveFailures := 0
+		// firstRun is true until the end of the first speedtest run, see
+		// below
+		firstRun := true
+		// total bytes transferred and number of successful cycles, used to
+		// estimate the monthly data usage
+		var (
+			totalBytes float64
+			cycles     int
+		)
+		randomServers := serverHistory{size: *flagRandomStuckRuns}
+		// IDs of the servers used so far
+		usedServers := make(map[string]struct{})
+		// cached server list, refreshed every -server-list-interval
+		var (
+			cachedServers   []SpeedtestServer
+			serversSourceIP string
+			serversFetched  time.Time
+		)
+		// server selected once and for all, see -pin-server
+		var pinnedServerID int
+		fail := func(reason string, err error) {
+			m.failures.WithLabelValues(reason).Inc()
+			m.streak.fail()
+			events.add("Speedtest failed", err.Error(), "failure")
+			consecutiveFailures++
+			if consecutiveFailures > *flagErrorGraceCount {
+				m.setError()
+			} else {
+				logrus.Infof("Keeping the last result (failure %d of %d allowed)", consecutiveFailures, *flagErrorGraceCount)
+			}
+		}
 		for {
+			if resetPending.Swap(false) {
+				usedServers = make(map[string]struct{})
+				totalBytes, cycles = 0, 0
+				randomServers = serverHistory{size: *flagRandomStuckRuns}
+				consecutiveFailures = 0
+			}
+			if len(maintenanceWindows) > 0 && inTimeWindows(maintenanceWindows, time.Now()) != *flagMaintenanceInvert {
+				sleep := jitteredInterval(*flagSleepInterval, *flagJitter)
+				logrus.Infof("Skipping speedtest because of the maintenance windows, sleeping %s...", sleep)
+				m.skipped.WithLabelValues("maintenance").Inc()
+				if giveUp(nil) {
+					return
+				}
+				time.Sleep(sleep)
+				continue
+			}
+			if link != nil {
+				wait, err := link.check(time.Now())
+				if errors.Is(err, errLinkDown) {
+					logrus.Infof("Skipping speedtest because %v, sleeping %s...", err, *flagRetryInterval)
+					m.skipped.WithLabelValues("link_down").Inc()
+					if giveUp(err) {
+						return
+					}
+					time.Sleep(*flagRetryInterval)
+					continue
+				} else if err != nil {
+					logrus.Warningf("Failed to check network interface: %v", err)
+				} else if wait > 0 {
+					logrus.Infof("Network interface %s came up recently, waiting %s for it to settle...", link.iface, wait)
+					time.Sleep(wait)
+				}
+			}
+			// the built-in backend has no CLI to watch
+			if cli != nil {
+				if modTime, changed, err := cli.check(); err != nil {
+					logrus.Warningf("Failed to check speedtest CLI: %v", err)
+				} else {
+					if changed {
+						logrus.Warningf("Speedtest CLI %s changed since the previous run", *flagSpeedTestCLI)
+						events.add("Speedtest CLI changed", *flagSpeedTestCLI, "cli")
+						m.cliChanged.Set(1)
+						m.setCLIVersion(*flagSpeedTestCLI)
+					} else {
+						m.cliChanged.Set(0)
+					}
+					m.cliModTime.Set(float64(modTime.Unix()))
+				}
+			}
 			serverIDs := make([]int, 0)
 			var (
-				res *speedTestResult
-				err error
+				res      *speedTestResult
+				err      error
+				sourceIP net.IP
 			)
-			if *flagServerRegexp == "" && *flagMaxDistance == 0 {
+			sourceIP, err = sourceAddress()
+			if err != nil {
+				logrus.Warningf("Failed to get source address: %v", err)
+				fail("interface", err)
+				if giveUp(err) {
+					return
+				}
+				logrus.Infof("Sleeping %s before retrying...", *flagRetryInterval)
+				time.Sleep(*flagRetryInterval)
+				continue
+			}
+			if sourceIP != nil {
+				logrus.Infof("Using source address %s", sourceIP)
+			}
+			if *flagHost != "" {
+				logrus.Infof("Using server %s", *flagHost)
+			} else if !useServerList {
 				// run the speedtest without any server preference
-				if *flagSpeedTestServerID != 0 {
-					logrus.Infof("Using server ID %d", *flagSpeedTestServerID)
-					serverIDs = []int{*flagSpeedTestServerID}
+				serverID := selectedServerID()
+				if serverID != 0 {
+					logrus.Infof("Using server ID %d", serverID)
+					serverIDs = []int{serverID}
 				} else {
 					logrus.Infof("Using random server")
 				}
+			} else if pinnedServerID != 0 {
+				logrus.Infof("Using pinned server ID %d", pinnedServerID)
+				serverIDs = []int{pinnedServerID}
 			} else {
-				allServers, err := getServers(*flagSpeedTestCLI, *flagInsecure)
-				if err != nil {
-					logrus.Warningf("Failed to get list of speedtest servers: %v", err)
-					setError(*speedtestSpeedGauge, speedtestPingGauge)
-					logrus.Infof("Sleeping %s before retrying to get server list...", *flagRetryInterval)
-					time.Sleep(*flagRetryInterval)
-					continue
-				}
-				logrus.Infof("Found %d total servers (before filtering)", len(allServers))
-				if serverRegexp != nil {
-					// filter servers by regexp first
-					logrus.Infof("Filtering servers matching regexp %q", *flagServerRegexp)
-					var servers []SpeedtestServer
-					for _, s := range allServers {
-						if serverRegexp.MatchString(s.Name) {
-							servers = append(servers, s)
-						}
-					}
-					logrus.Infof("Remaining servers after regexp filtering: %d", len(servers))
-					allServers = servers
-				}
-				if *flagMaxDistance > 0 {
-					logrus.Infof("Filtering servers within %d km", *flagMaxDistance)
-					var servers []SpeedtestServer
-					for _, s := range allServers {
-						if s.DistanceKm <= *flagMaxDistance {
-							servers = append(servers, s)
+				if cachedServers == nil || serversSourceIP != sourceIP.String() || time.Since(serversFetched) >= *flagServerListIntvl {
+					servers, err := getServers(ctx, *flagSpeedTestCLI, *flagInsecure, sourceIP, *flagTimeout)
+					if err != nil {
+						logrus.Warningf("Failed to get list of speedtest servers: %v", err)
+						fail("server_list", err)
+						if giveUp(err) {
+							return
 						}
+						logrus.Infof("Sleeping %s before retrying to get server list...", *flagRetryInterval)
+						time.Sleep(*flagRetryInterval)
+						continue
 					}
-					logrus.Infof("Remaining servers after distance filtering: %d", len(servers))
-					allServers = servers
+					cachedServers, serversSourceIP, serversFetched = servers, sourceIP.String(), time.Now()
+				} else {
+					logrus.Infof("Using server list fetched at %s", serversFetched.Format(time.RFC3339))
 				}
+				allServers := filters.filter(cachedServers)
+				m.candidateServers.Set(float64(len(allServers)))
 				// now get the list of server IDs from the filtered servers
 				for _, s := range allServers {
 					serverIDs = append(serverIDs, s.ID)
 				}
 				if len(serverIDs) == 0 {
 					logrus.Warningf("No server found within %d km", *flagMaxDistance)
-					setError(*speedtestSpeedGauge, speedtestPingGauge)
+					err := errors.New("no server found after filtering")
+					fail("no_server", err)
+					if giveUp(err) {
+						return
+					}
 					logrus.Infof("Sleeping %s before retrying to get server list...", *flagRetryInterval)
 					time.Sleep(*flagRetryInterval)
 					continue
 				}
 				logrus.Infof("Found %d servers after filtering", len(allServers))
 				for idx, s := range allServers {
-					logrus.Infof("%d) (ID: %d) %s, %d km", idx+1, s.ID, s.Name, s.DistanceKm)
+					logrus.Infof("%d) (ID: %d) %s, %.2f km", idx+1, s.ID, s.Name, s.DistanceKm)
+				}
+				if *flagServerRank > 0 {
+					sorted := append([]SpeedtestServer(nil), allServers...)
+					sort.SliceStable(sorted, func(i, j int) bool {
+						return sorted[i].DistanceKm < sorted[j].DistanceKm
+					})
+					rank := *flagServerRank
+					if rank > len(sorted) {
+						logrus.Warningf("Requested server rank %d but only %d servers are available, using the farthest one", rank, len(sorted))
+						rank = len(sorted)
+					}
+					s := sorted[rank-1]
+					logrus.Infof("Selected server ranked %d by distance: (ID: %d) %s, %.2f km", rank, s.ID, s.Name, s.DistanceKm)
+					serverIDs = []int{s.ID}
+				}
+				if *flagSelect == "latency" && len(serverIDs) > 1 {
+					id, err := lowestLatencyServer(ctx, *flagSpeedTestCLI, speedtestOptions{
+						serverIDs: serverIDs,
+						insecure:  *flagInsecure,
+						sourceIP:  sourceIP,
+						fieldMap:  fieldMap,
+						timeout:   *flagTimeout,
+					})
+					if err != nil {
+						logrus.Warningf("Failed to select the lowest-latency server, using all the candidates: %v", err)
+					} else {
+						serverIDs = []int{id}
+					}
+				}
+				if *flagPinServer {
+					if len(serverIDs) > 1 {
+						closest := allServers[0]
+						for _, s := range allServers[1:] {
+							if s.DistanceKm < closest.DistanceKm {
+								closest = s
+							}
+						}
+						serverIDs = []int{closest.ID}
+					}
+					pinnedServerID = serverIDs[0]
+					logrus.Infof("Pinning server ID %d for the next runs", pinnedServerID)
+				}
+			}
+			if *flagPreHook != "" {
+				if err := runHook(ctx, *flagPreHook, *flagTimeout); err != nil {
+					logrus.Warningf("Pre-run hook failed: %v", err)
 				}
 			}
 			logrus.Infof("Running speed test with server IDs %v", serverIDs)
-			res, err = speedtest(*flagSpeedTestCLI, serverIDs, *flagInsecure)
+			start := time.Now()
+			samples, err := runSamples(*flagSamples, func() (*speedTestResult, error) {
+				start := time.Now()
+				defer func() { m.runDurations.Observe(time.Since(start).Seconds()) }()
+				return speedtest(ctx, *flagSpeedTestCLI, speedtestOptions{
+					serverIDs: serverIDs,
+					insecure:  *flagInsecure,
+					sourceIP:  sourceIP,
+					pingOnly:  *flagPingOnly,
+					miniURL:   *flagHost,
+					fieldMap:  fieldMap,
+					timeout:   *flagTimeout,
+				})
+			})
+			if ctx.Err() != nil {
+				logrus.Infof("Stopping the background loop")
+				return
+			}
+			if err == nil {
+				res = meanResult(samples)
+			}
+			duration := time.Since(start)
+			m.duration.Set(duration.Seconds())
+			if *flagPostHook != "" {
+				if err := runHook(ctx, *flagPostHook, *flagTimeout, postHookEnv(res, err)...); err != nil {
+					logrus.Warningf("Post-run hook failed: %v", err)
+				}
+			}
+			if audit != nil {
+				rec := auditRecord{
+					Timestamp: start,
+					Backend:   backend,
+					ServerIDs: serverIDs,
+					Success:   err == nil,
+					Retries:   retries,
+					Result:    newResultPayload(res),
+				}
+				if err != nil {
+					rec.Error = err.Error()
+				}
+				if err := audit.record(rec); err != nil {
+					logrus.Warningf("Failed to write audit log: %v", err)
+				}
+			}
 			if err != nil {
-				if err == errRetryable403 {
-					logrus.Warningf("Retryable HTTP 403 error, sleeping for %s: %v", defaultRetryInterval, err)
-					time.Sleep(defaultRetryInterval)
+				if errors.Is(err, errRetryable) && (maxRetries == 0 || httpRetries < maxRetries) {
+					retries++
+					m.failures.WithLabelValues("retryable_http").Inc()
+					m.streak.fail()
+					events.add("Speedtest temporarily failed", err.Error(), "failure", "retryable")
+					httpRetries++
+					delay := retryDelay(err, backoffInterval(defaultRetryInterval, *flagMaxRetryInterval, httpRetries))
+					logrus.Warningf("Retryable HTTP error, sleeping for %s: %v", delay, err)
+					if !sleepContext(ctx, delay) {
+						logrus.Infof("Stopping the background loop")
+						return
+					}
 					continue
 				}
-				logrus.Warningf("Wailed to run speed test: %v", err)
+				if errors.Is(err, errConnection) && connRetries < *flagConnRetries {
+					connRetries++
+					retries++
+					m.failures.WithLabelValues("retryable_connection").Inc()
+					m.streak.fail()
+					events.add("Speedtest temporarily failed", err.Error(), "failure", "retryable")
+					logrus.Warningf("Connection error (retry %d of %d), sleeping for %s: %v", connRetries, *flagConnRetries, *flagConnRetryInterval, err)
+					if !sleepContext(ctx, *flagConnRetryInterval) {
+						logrus.Infof("Stopping the background loop")
+						return
+					}
+					continue
+				}
+				if errors.Is(err, errRetryable) {
+					logrus.Errorf("Giving up after %d retries: %v", httpRetries, err)
+					fail("max_retries", err)
+				} else {
+					logrus.Warningf("Wailed to run speed test: %v", err)
+					reason := "speedtest_run"
+					if errors.Is(err, errTimeout) {
+						reason = "timeout"
+					}
+					fail(reason, err)
+				}
+			} else if *flagPingOnly {
+				m.ping.Set(res.Ping)
+				m.runs.Inc()
+				m.streak.succeed()
+				consecutiveFailures = 0
 			} else {
-				// update value
-				speedtestSpeedGauge.Reset()
-				speedtestSpeedGauge.WithLabelValues(
-					"upload",
-					res.Client.IP.String(), res.Client.ISP, res.Client.Country,
-					res.Server.Sponsor, res.Server.Host, res.Server.Country,
-				).Set(res.Upload)
-				speedtestSpeedGauge.WithLabelValues(
-					"download",
-					res.Client.IP.String(), res.Client.ISP, res.Client.Country,
-					res.Server.Sponsor, res.Server.Host, res.Server.Country,
-				).Set(res.Download)
-				speedtestPingGauge.Set(res.Ping)
+				res.Interface = *flagBindInterface
+				res.Retries = retries
+				res.Duration = duration
+				if *flagPostprocessScript != "" {
+					if pres, err := postprocess(ctx, *flagPostprocessScript, *flagTimeout, res); err != nil {
+						logrus.Warningf("Post-processing failed, using the original result: %v", err)
+					} else {
+						logrus.Debugf("Post-processed result: %+v", pres)
+						res = pres
+					}
+				}
+				if *flagMaxDirectionSkew > 0 {
+					anomaly := skew.check(res.Download, res.Upload, *flagMaxDirectionSkew)
+					if anomaly {
+						logrus.Warningf("Download (%.0f bps) and upload (%.0f bps) are inconsistent with previous runs", res.Download, res.Upload)
+						events.add("Direction anomaly", fmt.Sprintf("download %.0f bps, upload %.0f bps", res.Download, res.Upload), "anomaly")
+						if *flagRetryOnSkew && !anomalyRetried {
+							anomalyRetried = true
+							logrus.Infof("Retrying speed test")
+							continue
+						}
+						m.directionAnomaly.Set(1)
+					} else {
+						m.directionAnomaly.Set(0)
+					}
+				}
+				m.setResult(res, *flagIPSubnetBits)
+				m.setSamples(samples)
+				for _, sample := range samples {
+					totalBytes += float64(sample.BytesSent + sample.BytesReceived)
+				}
+				cycles++
+				m.confidence.Set(resultConfidence(res, *confidenceWeights))
+				m.quality.Set(connectionQuality(resultQualityInputs(res), *qualityTargets, *qualityWeights))
+				if sla.DownloadBits > 0 || sla.PingMsec > 0 {
+					breached := sla.breached(res)
+					if breached {
+						logrus.Warningf("Result violates the SLA: download %.0f bps, ping %.2f ms", res.Download, res.Ping)
+						m.slaBreach.Set(1)
+					} else {
+						m.slaBreach.Set(0)
+					}
+					m.sla.set(breached)
+				}
+				if last := results.get(); last != nil {
+					if last.Server.ID != res.Server.ID {
+						events.add("Server changed", fmt.Sprintf("from %s (ID %s) to %s (ID %s)", last.Server.Sponsor, last.Server.ID, res.Server.Sponsor, res.Server.ID), "server")
+					}
+					if last.Client.ISP != res.Client.ISP {
+						logrus.Warningf("ISP changed from %q to %q", last.Client.ISP, res.Client.ISP)
+						events.add("ISP changed", fmt.Sprintf("from %s to %s", last.Client.ISP, res.Client.ISP), "isp")
+						m.ispChanged.Set(1)
+					} else {
+						m.ispChanged.Set(0)
+					}
+				}
+				if len(serverIDs) == 0 && *flagHost == "" && *flagRandomStuckRuns > 0 {
+					if randomServers.add(res.Server.ID) {
+						logrus.Warningf("The last %d runs all used server %s (ID %s) although no server was selected", *flagRandomStuckRuns, res.Server.Sponsor, res.Server.ID)
+						m.randomServerStuck.Set(1)
+					} else {
+						m.randomServerStuck.Set(0)
+					}
+				}
+				usedServers[res.Server.ID] = struct{}{}
+				m.distinctServers.Set(float64(len(usedServers)))
+				results.set(res)
+				m.runs.Inc()
+				m.streak.succeed()
+				consecutiveFailures = 0
+				if publisher != nil {
+					if err := publisher.publish(res); err != nil {
+						logrus.Warningf("Failed to publish result to MQTT: %v", err)
+					}
+				}
+			}
+			if len(paths) > 0 {
+				// use the same server on every path, so that the results
+				// are comparable
+				pathServerIDs := serverIDs
+				if res != nil {
+					if id, err := strconv.Atoi(res.Server.ID); err == nil {
+						pathServerIDs = []int{id}
+					}
+				}
+				totalBytes += runPathTests(ctx, m, *flagSpeedTestCLI, paths, speedtestOptions{
+					serverIDs: pathServerIDs,
+					insecure:  *flagInsecure,
+					pingOnly:  *flagPingOnly,
+					miniURL:   *flagHost,
+					fieldMap:  fieldMap,
+					timeout:   *flagTimeout,
+				})
+			}
+			if *flagCompareSecure {
+				totalBytes += runSecureComparison(ctx, m, *flagSpeedTestCLI, speedtestOptions{
+					sourceIP: sourceIP,
+					pingOnly: *flagPingOnly,
+					miniURL:  *flagHost,
+					fieldMap: fieldMap,
+					timeout:  *flagTimeout,
+				})
+			}
+			if cycles > 0 {
+				// include the bytes of the additional tests of -vpn-interface,
+				// -wan-interface and -compare-secure
+				m.monthlyBytes.Set(estimatedMonthlyBytes(totalBytes/float64(cycles), *flagSleepInterval))
+			}
+			retries = 0
+			anomalyRetried = false
+			connRetries = 0
+			httpRetries = 0
+			if *flagTextfileOut != "" {
+				if err := writeTextfile(reg, *flagTextfileOut); err != nil {
+					logrus.Warningf("Failed to write metrics to %s: %v", *flagTextfileOut, err)
+				}
+			}
+			if pusher != nil {
+				if err := pusher.Push(); err != nil {
+					logrus.Warningf("Failed to push metrics to %s: %v", *flagPushgateway, err)
+				}
+			}
+			sleep := jitteredInterval(*flagSleepInterval, *flagJitter)
+			// don't wait a full interval for the first data point if the
+			// first run failed, unless the retries were exhausted
+			if firstRun && err != nil && !errors.Is(err, errRetryable) {
+				sleep = *flagRetryInterval
+			}
+			firstRun = false
+			if giveUp(err) || !waitNextRun(sleep) {
+				return
 			}
-			logrus.Infof("Sleeping %s...", *flagSleepInterval)
-			time.Sleep(*flagSleepInterval)
 		}
-	}()
+	}
+	if *flagOneshot {
+		runLoop()
+		if oneshotErr == nil && ctx.Err() != nil {
+			oneshotErr = fmt.Errorf("speedtest interrupted: %w", ctx.Err())
+		}
+		if *flagTextfileOut == "" {
+			if err := writeMetrics(reg, os.Stdout); err != nil {
+				logrus.Fatalf("Failed to print metrics: %v", err)
+			}
+		}
+		if oneshotErr != nil {
+			logrus.Fatalf("Speed test failed: %v", oneshotErr)
+		}
+		return
+	}
+	if *flagBackgroundLoop {
+		go runLoop()
+	} else {
+		logrus.Infof("Background loop disabled, speedtests are only run via /probe")
+	}
+
+	if *flagPingInterval > 0 {
+		go func() {
+			for {
+				if len(maintenanceWindows) > 0 && inTimeWindows(maintenanceWindows, time.Now()) != *flagMaintenanceInvert {
+					logrus.Debugf("Skipping latency test because of the maintenance windows")
+					if !sleepContext(ctx, *flagPingInterval) {
+						return
+					}
+					continue
+				}
+				// ping the same server as the last full test, if any
+				var serverIDs []int
+				if last := results.get(); last != nil {
+					if id, err := strconv.Atoi(last.Server.ID); err == nil {
+						serverIDs = []int{id}
+					}
+				} else if *flagSpeedTestServerID != 0 && *flagHost == "" {
+					serverIDs = []int{*flagSpeedTestServerID}
+				}
+				sourceIP, err := sourceAddress()
+				if err != nil {
+					logrus.Warningf("Failed to get source address for latency test: %v", err)
+					if !sleepContext(ctx, *flagPingInterval) {
+						return
+					}
+					continue
+				}
+				logrus.Debugf("Running latency test with server IDs %v", serverIDs)
+				res, err := speedtest(ctx, *flagSpeedTestCLI, speedtestOptions{
+					serverIDs: serverIDs,
+					insecure:  *flagInsecure,
+					sourceIP:  sourceIP,
+					pingOnly:  true,
+					miniURL:   *flagHost,
+					fieldMap:  fieldMap,
+					timeout:   *flagTimeout,
+				})
+				if err != nil {
+					logrus.Warningf("Failed to run latency test: %v", err)
+				} else {
+					m.ping.Set(res.Ping)
+				}
+				if !sleepContext(ctx, *flagPingInterval) {
+					return
+				}
+			}
+		}()
+	}
 
-	http.Handle(*flagPath, promhttp.Handler())
-	logrus.Infof("Starting server on %s", *flagListen)
-	logrus.Fatal(http.ListenAndServe(*flagListen, nil))
+	http.Handle(*flagPath, withAuth(promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, reg}, promhttp.HandlerOpts{}),
+	)))
+	if *flagPath != "/" {
+		http.Handle("/", withAuth(landingHandler(*flagPath)))
+	}
+	http.Handle("/healthz", healthzHandler(results, *flagHealthzMaxAge))
+	// only the background loop serves the /run requests
+	if *flagBackgroundLoop && *flagMaxPendingRuns > 0 {
+		http.Handle("/run", withAuth(runHandler(runRequests, m.pendingRuns)))
+	}
+	// the probes would run on top of the background loop
+	if !*flagBackgroundLoop {
+		http.Handle("/probe", withAuth(probeHandler(newRegistry, results, *flagCacheTTL, *flagSpeedTestCLI, sourceAddress, selectedServerID, speedtestOptions{
+			insecure: *flagInsecure,
+			pingOnly: *flagPingOnly,
+			miniURL:  *flagHost,
+			fieldMap: fieldMap,
+			timeout:  *flagTimeout,
+			noWait:   true,
+		}, *flagIPSubnetBits)))
+	}
+	http.Handle("/baseline", withAuth(baselineHandler(results, baseline)))
+	http.Handle("/compare", withAuth(compareHandler(results, baseline)))
+	http.Handle("/annotations", withAuth(annotationsHandler(events)))
+	if *flagLastJSON {
+		http.Handle("/last.json", withAuth(lastResultHandler(results)))
+	}
+	if *flagAdminToken != "" {
+		http.Handle("/reset", resetHandler(*flagAdminToken, func() {
+			events.reset()
+			skew.reset()
+			results.set(nil)
+			// end the current failure streak
+			m.streak.succeed()
+			resetPending.Store(true)
+			m.distinctServers.Set(0)
+			m.monthlyBytes.Set(0)
+			m.randomServerStuck.Set(0)
+		}))
+	}
+	srv := &http.Server{Addr: *flagListen}
+	go func() {
+		<-ctx.Done()
+		logrus.Infof("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logrus.Warningf("Failed to shut down the HTTP server: %v", err)
+		}
+	}()
+	if *flagTLSCert != "" {
+		logrus.Infof("Starting HTTPS server on %s", *flagListen)
+		err = srv.ListenAndServeTLS(*flagTLSCert, *flagTLSKey)
+	} else {
+		logrus.Infof("Starting server on %s", *flagListen)
+		err = srv.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		logrus.Fatal(err)
+	}
+	// the speedtest CLI runs are killed when ctx is done, wait for them to
+	// exit. Other commands, e.g. -postprocess-script, are killed if they
+	// don't exit in time.
+	if !waitRunningCommands(shutdownTimeout) {
+		killRunningCommands()
+	}
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain runs the exporter instead of the tests when the test binary is
+// started by a test as a helper process, see runExporter.
+func TestMain(m *testing.M) {
+	if os.Getenv("SPEEDTEST_EXPORTER_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runExporter starts the exporter with the given arguments in a helper
+// process, which is killed at the end of the test.
+func runExporter(t *testing.T, args ...string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "SPEEDTEST_EXPORTER_TEST_MAIN=1")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start the exporter: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+}
+
+// countLines returns the number of lines of the given file, or 0 if it
+// doesn't exist.
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "\n")
+}
+
+func TestFirstRunRetry(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake speedtest CLI is a shell script")
+	}
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	cli := filepath.Join(dir, "speedtest-cli")
+	// a speedtest CLI that always fails, recording every run
+	script := "#!/bin/sh\n" +
+		"case \"$*\" in *--version*) echo speedtest-cli 2.1.3; exit 0;; esac\n" +
+		"echo run >> " + runs + "\n" +
+		"exit 1\n"
+	if err := os.WriteFile(cli, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	runExporter(t, "-s", cli, "-l", "127.0.0.1:0", "-i", "1h", "-r", "1s")
+
+	// the second run is attempted after -r instead of -i
+	deadline := time.Now().Add(10 * time.Second)
+	for countLines(t, runs) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d runs, want the first run to be retried after -r", countLines(t, runs))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// only the first wait is shortened, the next ones last -i
+	time.Sleep(3 * time.Second)
+	if n := countLines(t, runs); n != 2 {
+		t.Errorf("got %d runs, want 2 until -i elapses", n)
+	}
+}
+
+func TestParseServerList(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want []SpeedtestServer
+	}{
+		{
+			name: "plain",
+			line: "1234) Acme (Milan, Italy) [12.34 km]",
+			want: []SpeedtestServer{{ID: 1234, Name: "Acme (Milan, Italy)", DistanceKm: 12.34, Country: "Italy"}},
+		},
+		{
+			name: "brackets in the name",
+			line: "42) Acme [Fiber] (Milan, Italy) [3.50 km]",
+			want: []SpeedtestServer{{ID: 42, Name: "Acme [Fiber] (Milan, Italy)", DistanceKm: 3.5, Country: "Italy"}},
+		},
+		{
+			name: "distance-like brackets in the name",
+			line: "42) Acme [1.00 km] (Milan, Italy) [3.50 km]",
+			want: []SpeedtestServer{{ID: 42, Name: "Acme [1.00 km] (Milan, Italy)", DistanceKm: 3.5, Country: "Italy"}},
+		},
+		{
+			name: "unbalanced bracket in the name",
+			line: "42) Acme ]Fiber (Milan, Italy) [3.50 km]",
+			want: []SpeedtestServer{{ID: 42, Name: "Acme ]Fiber (Milan, Italy)", DistanceKm: 3.5, Country: "Italy"}},
+		},
+		{
+			name: "surrounding whitespace",
+			line: "  42) Acme (Milan, Italy) [3.50 km]  ",
+			want: []SpeedtestServer{{ID: 42, Name: "Acme (Milan, Italy)", DistanceKm: 3.5, Country: "Italy"}},
+		},
+		{
+			name: "no country",
+			line: "42) Acme [3.50 km]",
+			want: []SpeedtestServer{{ID: 42, Name: "Acme", DistanceKm: 3.5}},
+		},
+		{
+			name: "whole-number distance",
+			line: "42) Acme (Milan, Italy) [12 km]",
+			want: []SpeedtestServer{{ID: 42, Name: "Acme (Milan, Italy)", DistanceKm: 12, Country: "Italy"}},
+		},
+		{
+			name: "one decimal distance",
+			line: "42) Acme (Milan, Italy) [12.3 km]",
+			want: []SpeedtestServer{{ID: 42, Name: "Acme (Milan, Italy)", DistanceKm: 12.3, Country: "Italy"}},
+		},
+		{
+			name: "header",
+			line: "Retrieving speedtest.net configuration...",
+		},
+		{
+			name: "no distance",
+			line: "42) Acme (Milan, Italy)",
+		},
+		{
+			name: "text after the distance",
+			line: "42) Acme (Milan, Italy) [3.50 km] extra",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseServerList(strings.NewReader(tt.line + "\n"))
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,809 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// metrics holds all the collectors exported by the speedtest exporter.
+type metrics struct {
+	// noZeroOnError controls how setError reports failures
+	noZeroOnError bool
+	// roundTo and roundSigFigs control the rounding of the exported speeds,
+	// see roundSpeed
+	roundTo      float64
+	roundSigFigs int
+	// namespace is the prefix of the metric names, see -namespace
+	namespace string
+	// speedLabels are the labels of the speed gauge, see speedLabelValues
+	speedLabels []string
+	speed       *prometheus.GaugeVec
+	// serverInfo describes the server of the last result, so that the speed
+	// gauge doesn't need a label for each of its attributes
+	serverInfo *prometheus.GaugeVec
+	ping       prometheus.Gauge
+	duration   prometheus.Gauge
+	// runDurations is observed once per speedtest CLI invocation, while
+	// duration covers all the samples of a cycle
+	runDurations prometheus.Histogram
+	loggedIn     prometheus.Gauge
+	confidence   prometheus.Gauge
+	quality      prometheus.Gauge
+	distance     prometheus.Gauge
+	latency      prometheus.Gauge
+	// clientLat and clientLon are not reset on failure, since 0 is a valid
+	// coordinate
+	clientLat prometheus.Gauge
+	clientLon prometheus.Gauge
+	// jitter and packetLoss are NaN if the backend doesn't report them
+	jitter     prometheus.Gauge
+	packetLoss prometheus.Gauge
+	// bytesSent and bytesReceived are the data transferred by the last run
+	bytesSent     prometheus.Gauge
+	bytesReceived prometheus.Gauge
+	overhead      prometheus.Gauge
+	skipped       *prometheus.CounterVec
+	failures      *prometheus.CounterVec
+	runs          prometheus.Counter
+	pendingRuns   prometheus.Gauge
+	clockSkew     prometheus.Gauge
+	hadStderr     prometheus.Gauge
+	samples       prometheus.Gauge
+	cliModTime    prometheus.Gauge
+	cliChanged    prometheus.Gauge
+	ispChanged    prometheus.Gauge
+	// monthlyBytes is set by the main loop from the average data usage
+	monthlyBytes prometheus.Gauge
+	// pathSpeed and pathPing are set by runPathTests
+	pathSpeed *prometheus.GaugeVec
+	pathPing  *prometheus.GaugeVec
+	// secureSpeed and securePing are set by runSecureComparison
+	secureSpeed *prometheus.GaugeVec
+	securePing  *prometheus.GaugeVec
+	buildInfo   prometheus.Gauge
+	// cliInfo is set by the main loop, see setCLIVersion
+	cliInfo *prometheus.GaugeVec
+	// filterInfo is set at startup from the server selection flags
+	filterInfo *prometheus.GaugeVec
+	// distinctServers is set by the main loop from the set of servers used
+	distinctServers prometheus.Gauge
+	// candidateServers is set by the main loop after filtering the server
+	// list
+	candidateServers prometheus.Gauge
+	medianSpeed      *prometheus.GaugeVec
+	medianPing       *prometheus.GaugeVec
+	// streak tracks the current failure streak, and is exported as the
+	// time spent retrying.
+	streak *failureStreak
+	// results holds the last successful result, whose age is exported by
+	// resultAge
+	results       *resultStore
+	resultAge     prometheus.GaugeFunc
+	retryDuration prometheus.GaugeFunc
+	// randomServerStuck is set by the main loop, see -random-stuck-runs
+	randomServerStuck prometheus.Gauge
+	// directionAnomaly is set by the main loop, see -max-direction-skew
+	directionAnomaly prometheus.Gauge
+	// firstRun is only set by the first successful run after startup, so
+	// that dashboards can mark exporter restarts.
+	firstRun     *prometheus.GaugeVec
+	firstRunOnce sync.Once
+	// slaBreach is set by the main loop, see -sla-download-bits and
+	// -sla-ping-msec
+	slaBreach        prometheus.Gauge
+	sla              *slaTracker
+	slaBreachSeconds prometheus.CounterFunc
+}
+
+// namedCollector associates a collector with the base name used by
+// -enable-metrics and -disable-metrics.
+type namedCollector struct {
+	name      string
+	collector prometheus.Collector
+}
+
+// defaultSpeedLabels are the labels of the speed gauge, in order.
+var defaultSpeedLabels = []string{"direction", "interface"}
+
+// optionalSpeedLabels are the labels that can be added to the speed gauge with
+// -labels. They are opt-in, since they increase the metric cardinality and
+// client_ip may be considered personal data.
+var optionalSpeedLabels = []string{"client_ip", "client_isp", "client_country", "server_sponsor", "server_host", "server_country"}
+
+// parseSpeedLabels parses a comma-separated list of optional speed labels, and
+// returns them in the order of optionalSpeedLabels.
+func parseSpeedLabels(s string) ([]string, error) {
+	names := parseMetricNames(s)
+	var labels []string
+	for _, name := range optionalSpeedLabels {
+		if names[name] {
+			labels = append(labels, name)
+			delete(names, name)
+		}
+	}
+	for name := range names {
+		return nil, fmt.Errorf("unknown label %q, valid labels are %s", name, strings.Join(optionalSpeedLabels, ","))
+	}
+	return labels, nil
+}
+
+// newMetrics returns the exporter metrics, whose names are prefixed with
+// namespace. The speed gauge carries extraLabels in addition to
+// defaultSpeedLabels, see speedLabelValues.
+func newMetrics(namespace string, extraLabels []string) *metrics {
+	speedLabels := append(append([]string(nil), defaultSpeedLabels...), extraLabels...)
+	streak := &failureStreak{}
+	sla := &slaTracker{}
+	results := &resultStore{}
+	buildInfo := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "exporter_build_info",
+		Help:      "Build information of the speedtest exporter, always 1",
+		ConstLabels: prometheus.Labels{
+			"version":    version,
+			"commit":     buildCommit(),
+			"go_version": runtime.Version(),
+		},
+	})
+	buildInfo.Set(1)
+	return &metrics{
+		namespace:   namespace,
+		speedLabels: speedLabels,
+		speed: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "speed_bits_per_second",
+				Help:      "SpeedTest.net upload and download speed",
+			},
+			speedLabels,
+		),
+		serverInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "server_info",
+				Help:      "SpeedTest.net server used by the last run, always 1",
+			},
+			[]string{"id", "name", "sponsor", "host", "country"},
+		),
+		ping: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "ping_msec",
+			Help:      "SpeedTest.net ping latency in milliseconds",
+		}),
+		// the speedtest CLI doesn't report how long the transfers lasted, so
+		// we measure the whole run. Short runs on links with burst allowances
+		// (e.g. DOCSIS PowerBoost) may report a speed higher than the
+		// sustained one.
+		duration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "run_duration_seconds",
+			Help:      "Duration of the last SpeedTest.net run in seconds",
+		}),
+		runDurations: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "cli_duration_seconds",
+			Help:      "Duration of the SpeedTest.net CLI runs in seconds",
+			Buckets:   []float64{5, 10, 15, 20, 30, 45, 60, 90, 120, 180, 300},
+		}),
+		loggedIn: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "logged_in",
+			Help:      "Whether the speedtest CLI was logged in to a SpeedTest.net account (1) or not (0)",
+		}),
+		confidence: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "result_confidence",
+			Help:      "Confidence in the last SpeedTest.net result, between 0 and 1",
+		}),
+		quality: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "connection_quality_score",
+			Help:      "Connection quality score between 0 and 100, computed from the last SpeedTest.net result",
+		}),
+		distance: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "server_distance_km",
+			Help:      "Distance in km to the SpeedTest.net server used by the last run",
+		}),
+		latency: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "server_latency_msec",
+			Help:      "Latency in milliseconds measured by speedtest-cli when selecting the SpeedTest.net server of the last run",
+		}),
+		clientLat: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "client_latitude",
+			Help:      "Latitude of the client as geolocated by SpeedTest.net",
+		}),
+		clientLon: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "client_longitude",
+			Help:      "Longitude of the client as geolocated by SpeedTest.net",
+		}),
+		jitter: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "jitter_msec",
+			Help:      "SpeedTest.net jitter in milliseconds, or NaN if not reported",
+		}),
+		packetLoss: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "packet_loss_ratio",
+			Help:      "SpeedTest.net packet loss between 0 and 1, or NaN if not reported",
+		}),
+		bytesSent: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "bytes_sent_total",
+			Help:      "Bytes sent by the last SpeedTest.net run",
+		}),
+		bytesReceived: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "bytes_received_total",
+			Help:      "Bytes received by the last SpeedTest.net run",
+		}),
+		overhead: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "latency_overhead_ratio",
+			Help:      "Ratio between the measured ping and the theoretical minimum round-trip time to the server given its distance",
+		}),
+		failures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "failures_total",
+				Help:      "Number of failed SpeedTest.net runs",
+			},
+			[]string{"reason"},
+		),
+		runs: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "runs_total",
+			Help:      "Number of successful SpeedTest.net runs",
+		}),
+		skipped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "skipped_total",
+				Help:      "Number of SpeedTest.net runs that were skipped",
+			},
+			[]string{"reason"},
+		),
+		pendingRuns: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "pending_runs",
+			Help:      "Number of SpeedTest.net runs requested via the /run endpoint that haven't started yet",
+		}),
+		clockSkew: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "result_clock_skew_seconds",
+			Help:      "Difference between the exporter's clock at the start of the last run and the timestamp reported by the speedtest CLI",
+		}),
+		hadStderr: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_run_had_stderr",
+			Help:      "Whether the speedtest CLI printed anything on stderr during the last successful run (1) or not (0)",
+		}),
+		samples: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "samples",
+			Help:      "Number of successful samples the last SpeedTest.net result was computed from",
+		}),
+		medianSpeed: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "median_speed_bits_per_second",
+				Help:      "Median SpeedTest.net upload and download speed across the samples of the last run, only set if -samples is greater than 1",
+			},
+			[]string{"direction"},
+		),
+		medianPing: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "median_ping_msec",
+				Help:      "Median SpeedTest.net ping latency in milliseconds across the samples of the last run, only set if -samples is greater than 1",
+			},
+			nil,
+		),
+		cliModTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "cli_mtime_seconds",
+			Help:      "Modification time of the speedtest CLI binary, in seconds since the epoch",
+		}),
+		cliChanged: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "cli_changed",
+			Help:      "Whether the speedtest CLI binary changed since the previous run (1) or not (0)",
+		}),
+		ispChanged: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "isp_changed",
+			Help:      "Whether the client ISP changed since the previous successful run (1) or not (0)",
+		}),
+		monthlyBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "estimated_monthly_bytes",
+			Help:      "Estimated monthly data usage of the speedtests at the current interval, in bytes",
+		}),
+		pathSpeed: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "path_speed_bits_per_second",
+				Help:      "SpeedTest.net upload and download speed over each network path",
+			},
+			[]string{"direction", "path"},
+		),
+		pathPing: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "path_ping_msec",
+				Help:      "SpeedTest.net ping latency in milliseconds over each network path",
+			},
+			[]string{"path"},
+		),
+		secureSpeed: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "secure_speed_bits_per_second",
+				Help:      "SpeedTest.net upload and download speed with and without HTTPS",
+			},
+			[]string{"direction", "secure"},
+		),
+		securePing: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "secure_ping_msec",
+				Help:      "SpeedTest.net ping latency in milliseconds with and without HTTPS",
+			},
+			[]string{"secure"},
+		),
+		buildInfo: buildInfo,
+		cliInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "cli_info",
+				Help:      "Version of the speedtest CLI, always 1",
+			},
+			[]string{"version"},
+		),
+		filterInfo: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "filter_info",
+				Help:      "Server selection filters in effect, always 1",
+			},
+			[]string{"regexp", "max_distance_km", "exclude_zero_distance", "server_rank", "country"},
+		),
+		distinctServers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "distinct_servers_used",
+			Help:      "Number of distinct SpeedTest.net servers used since the exporter started",
+		}),
+		candidateServers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "candidate_servers",
+			Help:      "Number of SpeedTest.net servers remaining after filtering the server list",
+		}),
+		streak:  streak,
+		results: results,
+		resultAge: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "result_age_seconds",
+				Help:      "Time elapsed since the currently exported SpeedTest.net result was obtained, or NaN if there is none",
+			},
+			func() float64 {
+				age, ok := results.age()
+				if !ok {
+					return math.NaN()
+				}
+				return age.Seconds()
+			},
+		),
+		retryDuration: prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "retry_duration_seconds",
+				Help:      "Time elapsed since the first failure of the current failure streak, or 0 if the last run succeeded",
+			},
+			func() float64 { return streak.duration().Seconds() },
+		),
+		randomServerStuck: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "random_server_stuck",
+			Help:      "Whether the last -random-stuck-runs runs in random server mode all used the same server (1) or not (0)",
+		}),
+		directionAnomaly: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "direction_anomaly",
+			Help:      "Whether the download/upload ratio of the last run was inconsistent with previous runs (1) or not (0)",
+		}),
+		firstRun: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "first_run_speed_bits_per_second",
+				Help:      "SpeedTest.net upload and download speed of the first successful run after startup",
+			},
+			[]string{"direction"},
+		),
+		slaBreach: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "sla_breach",
+			Help:      "Whether the last SpeedTest.net result violated the SLA (1) or not (0)",
+		}),
+		sla: sla,
+		slaBreachSeconds: prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "sla_breach_seconds_total",
+				Help:      "Total time spent in breach of the SLA, in seconds",
+			},
+			func() float64 { return sla.duration().Seconds() },
+		),
+	}
+}
+
+func (m *metrics) collectors() []namedCollector {
+	return []namedCollector{
+		{"speed", m.speed},
+		{"server_info", m.serverInfo},
+		{"ping", m.ping},
+		{"duration", m.duration},
+		{"cli_duration", m.runDurations},
+		{"logged_in", m.loggedIn},
+		{"confidence", m.confidence},
+		{"quality", m.quality},
+		{"distance", m.distance},
+		{"server_latency", m.latency},
+		{"client_location", m.clientLat},
+		{"client_location", m.clientLon},
+		{"jitter", m.jitter},
+		{"packet_loss", m.packetLoss},
+		{"bytes", m.bytesSent},
+		{"bytes", m.bytesReceived},
+		{"latency_overhead", m.overhead},
+		{"failures", m.failures},
+		{"runs", m.runs},
+		{"skipped", m.skipped},
+		{"pending_runs", m.pendingRuns},
+		{"clock_skew", m.clockSkew},
+		{"had_stderr", m.hadStderr},
+		{"samples", m.samples},
+		{"median", m.medianSpeed},
+		{"median", m.medianPing},
+		{"cli_mtime", m.cliModTime},
+		{"cli_changed", m.cliChanged},
+		{"isp_changed", m.ispChanged},
+		{"monthly_bytes", m.monthlyBytes},
+		{"path", m.pathSpeed},
+		{"path", m.pathPing},
+		{"secure", m.secureSpeed},
+		{"secure", m.securePing},
+		{"build_info", m.buildInfo},
+		{"cli_info", m.cliInfo},
+		{"filter_info", m.filterInfo},
+		{"distinct_servers", m.distinctServers},
+		{"candidate_servers", m.candidateServers},
+		{"result_age", m.resultAge},
+		{"retry_duration", m.retryDuration},
+		{"random_server_stuck", m.randomServerStuck},
+		{"direction_anomaly", m.directionAnomaly},
+		{"first_run", m.firstRun},
+		{"sla_breach", m.slaBreach},
+		{"sla_breach_seconds", m.slaBreachSeconds},
+	}
+}
+
+// register registers the enabled metrics with the given registerer. Metrics
+// that are not registered are still updated, but they don't show up in the
+// exposition. If `enabled` is empty, all the metrics that are not explicitly
+// disabled are registered.
+func (m *metrics) register(reg prometheus.Registerer, enabled, disabled map[string]bool) error {
+	collectors := m.collectors()
+	known := make(map[string]bool, len(collectors))
+	names := make([]string, 0, len(collectors))
+	for _, nc := range collectors {
+		// some base names cover several collectors
+		if !known[nc.name] {
+			names = append(names, nc.name)
+		}
+		known[nc.name] = true
+	}
+	for _, set := range []map[string]bool{enabled, disabled} {
+		for name := range set {
+			if !known[name] {
+				logrus.Warningf("Unknown metric name %q, valid names are %s", name, strings.Join(names, ","))
+			}
+		}
+	}
+	for _, nc := range collectors {
+		if (len(enabled) > 0 && !enabled[nc.name]) || disabled[nc.name] {
+			logrus.Infof("Metric %q is disabled", nc.name)
+			continue
+		}
+		if err := reg.Register(nc.collector); err != nil {
+			return fmt.Errorf("failed to register speedtest %s metric: %w", nc.name, err)
+		}
+	}
+	return nil
+}
+
+// speedLabelValues returns the speed gauge labels for the given direction
+// and result. If res is nil, all the labels but the direction are empty.
+func (m *metrics) speedLabelValues(direction string, res *speedTestResult, subnetBits int) prometheus.Labels {
+	values := prometheus.Labels{"direction": direction}
+	if res != nil {
+		values["client_ip"] = clientIPLabel(res.Client.IP, subnetBits)
+		values["client_isp"] = res.Client.ISP
+		values["client_country"] = res.Client.Country
+		values["server_sponsor"] = res.Server.Sponsor
+		values["server_host"] = res.Server.Host
+		values["server_country"] = res.Server.Country
+		values["server_id"] = res.Server.ID
+		values["interface"] = res.Interface
+	}
+	labels := make(prometheus.Labels, len(m.speedLabels))
+	for _, name := range m.speedLabels {
+		labels[name] = values[name]
+	}
+	return labels
+}
+
+// setResult updates the metrics from a successful speedtest result.
+func (m *metrics) setResult(res *speedTestResult, subnetBits int) {
+	m.speed.Reset()
+	m.speed.With(m.speedLabelValues("upload", res, subnetBits)).Set(m.roundSpeed(res.Upload))
+	m.speed.With(m.speedLabelValues("download", res, subnetBits)).Set(m.roundSpeed(res.Download))
+	m.serverInfo.Reset()
+	m.serverInfo.With(prometheus.Labels{
+		"id":      res.Server.ID,
+		"name":    res.Server.Name,
+		"sponsor": res.Server.Sponsor,
+		"host":    res.Server.Host,
+		"country": res.Server.Country,
+	}).Set(1)
+	m.ping.Set(res.Ping)
+	m.bytesSent.Set(float64(res.BytesSent))
+	m.bytesReceived.Set(float64(res.BytesReceived))
+	m.firstRunOnce.Do(func() {
+		m.firstRun.WithLabelValues("upload").Set(m.roundSpeed(res.Upload))
+		m.firstRun.WithLabelValues("download").Set(m.roundSpeed(res.Download))
+	})
+	m.distance.Set(res.Server.D)
+	m.latency.Set(res.Server.Latency)
+	m.clientLat.Set(parseCoordinate(res.Client.Lat))
+	m.clientLon.Set(parseCoordinate(res.Client.Lon))
+	m.jitter.Set(optionalValue(res.Jitter))
+	m.packetLoss.Set(optionalValue(res.PacketLoss))
+	m.overhead.Set(latencyOverheadRatio(res.Ping, res.Server.D))
+	if res.Timestamp.IsZero() || res.Started.IsZero() {
+		m.clockSkew.Set(math.NaN())
+	} else {
+		// speedtest-cli stamps the result when the test starts
+		m.clockSkew.Set(res.Started.Sub(res.Timestamp).Seconds())
+	}
+	if res.Stderr != "" {
+		m.hadStderr.Set(1)
+	} else {
+		m.hadStderr.Set(0)
+	}
+	if res.Client.LoggedIn == "1" || strings.EqualFold(res.Client.LoggedIn, "true") {
+		m.loggedIn.Set(1)
+	} else {
+		m.loggedIn.Set(0)
+	}
+}
+
+// setSamples updates the metrics that depend on the individual samples of a
+// run. Medians are only exported if there is more than one sample.
+func (m *metrics) setSamples(samples []*speedTestResult) {
+	m.samples.Set(float64(len(samples)))
+	if len(samples) < 2 {
+		m.medianSpeed.Reset()
+		m.medianPing.Reset()
+		return
+	}
+	m.medianSpeed.WithLabelValues("upload").Set(m.roundSpeed(median(samples, func(r *speedTestResult) float64 { return r.Upload })))
+	m.medianSpeed.WithLabelValues("download").Set(m.roundSpeed(median(samples, func(r *speedTestResult) float64 { return r.Download })))
+	m.medianPing.WithLabelValues().Set(median(samples, func(r *speedTestResult) float64 { return r.Ping }))
+}
+
+// parseCoordinate parses a latitude or longitude as reported by
+// speedtest-cli, and returns NaN if it is missing or invalid.
+func parseCoordinate(s string) float64 {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return v
+}
+
+// optionalValue returns the value pointed to by v, or NaN if v is nil.
+func optionalValue(v *float64) float64 {
+	if v == nil {
+		return math.NaN()
+	}
+	return *v
+}
+
+// roundSpeed rounds a speed to the nearest multiple of roundTo and then to
+// roundSigFigs significant figures, if set.
+func (m *metrics) roundSpeed(v float64) float64 {
+	if m.roundTo > 0 {
+		v = math.Round(v/m.roundTo) * m.roundTo
+	}
+	if m.roundSigFigs > 0 && v != 0 {
+		magnitude := math.Pow(10, float64(m.roundSigFigs)-math.Ceil(math.Log10(math.Abs(v))))
+		v = math.Round(v*magnitude) / magnitude
+	}
+	return v
+}
+
+// resultGauges returns the gauges that are set from a result, and that are
+// reset by setError.
+func (m *metrics) resultGauges() []prometheus.Gauge {
+	return []prometheus.Gauge{
+		m.ping,
+		m.samples,
+		m.loggedIn,
+		m.confidence,
+		m.quality,
+		m.distance,
+		m.latency,
+		m.jitter,
+		m.packetLoss,
+		m.bytesSent,
+		m.bytesReceived,
+		m.overhead,
+	}
+}
+
+// setError resets the metrics after a failure. Unless noZeroOnError is set,
+// the speed and ping metrics are set to zero. Otherwise the speed series are
+// removed so that Prometheus marks them as stale, and the plain gauges are set
+// to NaN.
+func (m *metrics) setError() {
+	m.speed.Reset()
+	m.serverInfo.Reset()
+	m.medianSpeed.Reset()
+	m.medianPing.Reset()
+	value := 0.0
+	if m.noZeroOnError {
+		value = math.NaN()
+	} else {
+		m.speed.With(m.speedLabelValues("upload", nil, 0)).Set(0)
+		m.speed.With(m.speedLabelValues("download", nil, 0)).Set(0)
+	}
+	for _, g := range m.resultGauges() {
+		g.Set(value)
+	}
+}
+
+// failureStreak tracks since when the speedtest has been failing. It is safe
+// for concurrent use.
+type failureStreak struct {
+	mu    sync.Mutex
+	since time.Time
+}
+
+// fail records a failure. Only the first failure of a streak is recorded.
+func (f *failureStreak) fail() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.since.IsZero() {
+		f.since = time.Now()
+	}
+}
+
+// succeed ends the current failure streak.
+func (f *failureStreak) succeed() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.since = time.Time{}
+}
+
+// duration returns the time elapsed since the beginning of the current
+// failure streak, or 0 if there is none.
+func (f *failureStreak) duration() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.since.IsZero() {
+		return 0
+	}
+	return time.Since(f.since)
+}
+
+// setCLIVersion exports the version of the speedtest CLI at the given path.
+func (m *metrics) setCLIVersion(cliPath string) {
+	v, err := cliVersion(cliPath)
+	if err != nil {
+		logrus.Warningf("%v", err)
+		return
+	}
+	logrus.Infof("Speedtest CLI version is %s", v)
+	m.cliInfo.Reset()
+	m.cliInfo.WithLabelValues(v).Set(1)
+}
+
+// maxFilterLabelLen is the maximum length of the regexp label of
+// speedtest_filter_info.
+const maxFilterLabelLen = 128
+
+// setFilterInfo exports the given server selection filters. Filters that are
+// not in effect have empty labels.
+func (m *metrics) setFilterInfo(regexp string, maxDistanceKm int, excludeZeroDistance bool, serverRank int, country string) {
+	if len(regexp) > maxFilterLabelLen {
+		regexp = regexp[:maxFilterLabelLen] + "..."
+	}
+	labels := prometheus.Labels{"regexp": regexp, "max_distance_km": "", "exclude_zero_distance": "", "server_rank": "", "country": country}
+	if maxDistanceKm > 0 {
+		labels["max_distance_km"] = strconv.Itoa(maxDistanceKm)
+	}
+	if excludeZeroDistance {
+		labels["exclude_zero_distance"] = "true"
+	}
+	if serverRank > 0 {
+		labels["server_rank"] = strconv.Itoa(serverRank)
+	}
+	m.filterInfo.Reset()
+	m.filterInfo.With(labels).Set(1)
+}
+
+// estimatedMonthlyBytes projects the data used in a 30-day month given the
+// average number of bytes transferred per cycle and the interval between
+// cycles. The duration of the cycles themselves is ignored.
+func estimatedMonthlyBytes(bytesPerCycle float64, interval time.Duration) float64 {
+	const month = 30 * 24 * time.Hour
+	return bytesPerCycle * float64(month) / float64(interval)
+}
+
+// fiberSpeedKmPerMsec is the approximate speed of light in optical fiber.
+const fiberSpeedKmPerMsec = 200
+
+// latencyOverheadRatio returns the ratio between the measured ping and the
+// minimum round-trip time allowed by the speed of light in fiber over the
+// given distance. It returns NaN if the distance is unknown.
+func latencyOverheadRatio(pingMsec, distanceKm float64) float64 {
+	if distanceKm <= 0 {
+		return math.NaN()
+	}
+	minRTT := 2 * distanceKm / fiberSpeedKmPerMsec
+	return pingMsec / minRTT
+}
+
+// parseMetricNames parses a comma-separated list of metric base names.
+func parseMetricNames(s string) map[string]bool {
+	names := make(map[string]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		names[name] = true
+	}
+	return names
+}
+
+// clientIPLabel returns the value of the client_ip label for the given IP. If
+// subnetBits is greater than 0, the address is masked to its network prefix
+// and returned in CIDR notation.
+func clientIPLabel(ip net.IP, subnetBits int) string {
+	if subnetBits <= 0 || ip == nil {
+		return ip.String()
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	bits := 8 * len(ip)
+	if subnetBits > bits {
+		subnetBits = bits
+	}
+	ipnet := net.IPNet{IP: ip.Mask(net.CIDRMask(subnetBits, bits)), Mask: net.CIDRMask(subnetBits, bits)}
+	return ipnet.String()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sirupsen/logrus"
+)
+
+const mqttTimeout = 10 * time.Second
+
+// mqttPublisher publishes speedtest results as JSON to an MQTT topic, e.g. for
+// Home Assistant.
+type mqttPublisher struct {
+	client mqtt.Client
+	topic  string
+}
+
+func newMQTTPublisher(broker, topic, clientID, username, password string) (*mqttPublisher, error) {
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetUsername(username).
+		SetPassword(password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logrus.Warningf("Lost connection to MQTT broker %s: %v", broker, err)
+		})
+	client := mqtt.NewClient(opts)
+	// with SetConnectRetry the token only completes once connected, so don't
+	// block the startup if the broker is not reachable yet.
+	if token := client.Connect(); token.WaitTimeout(mqttTimeout) && token.Error() != nil {
+		return nil, fmt.Errorf("failed to connect to MQTT broker %s: %w", broker, token.Error())
+	}
+	return &mqttPublisher{client: client, topic: topic}, nil
+}
+
+func (p *mqttPublisher) publish(res *speedTestResult) error {
+	payload, err := json.Marshal(newResultPayload(res))
+	if err != nil {
+		return fmt.Errorf("failed to marshal result: %w", err)
+	}
+	token := p.client.Publish(p.topic, 1, true, payload)
+	if !token.WaitTimeout(mqttTimeout) {
+		return fmt.Errorf("timed out publishing to MQTT topic %q", p.topic)
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("failed to publish to MQTT topic %q: %w", p.topic, err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// testPath is a network path whose performance is compared to the others,
+// e.g. a VPN tunnel and the bare WAN.
+type testPath struct {
+	name  string
+	iface string
+}
+
+// runPathTests runs one speedtest per path, bound to the address of the
+// path's interface, and exports the results with a path label. The source
+// address in opts is ignored. It returns the number of bytes transferred by
+// the successful tests.
+func runPathTests(ctx context.Context, m *metrics, cliPath string, paths []testPath, opts speedtestOptions) float64 {
+	var bytes float64
+	for _, p := range paths {
+		ip, err := interfaceIP(p.iface)
+		if err != nil {
+			logrus.Warningf("Failed to get source address for path %s: %v", p.name, err)
+			m.setPathError(p.name)
+			continue
+		}
+		opts.sourceIP = ip
+		logrus.Infof("Running speed test on path %s from %s (%s)", p.name, p.iface, ip)
+		res, err := speedtest(ctx, cliPath, opts)
+		if err != nil {
+			logrus.Warningf("Failed to run speed test on path %s: %v", p.name, err)
+			m.setPathError(p.name)
+			continue
+		}
+		m.setPathResult(p.name, res, opts.pingOnly)
+		bytes += float64(res.BytesSent + res.BytesReceived)
+	}
+	return bytes
+}
+
+// setPathResult updates the per-path metrics from a successful result.
+func (m *metrics) setPathResult(path string, res *speedTestResult, pingOnly bool) {
+	if !pingOnly {
+		m.pathSpeed.With(prometheus.Labels{"direction": "upload", "path": path}).Set(m.roundSpeed(res.Upload))
+		m.pathSpeed.With(prometheus.Labels{"direction": "download", "path": path}).Set(m.roundSpeed(res.Download))
+	}
+	m.pathPing.With(prometheus.Labels{"path": path}).Set(res.Ping)
+}
+
+// setPathError resets the per-path metrics after a failure, following the
+// same rules as setError.
+func (m *metrics) setPathError(path string) {
+	if m.noZeroOnError {
+		m.pathSpeed.DeletePartialMatch(prometheus.Labels{"path": path})
+		m.pathPing.With(prometheus.Labels{"path": path}).Set(math.NaN())
+		return
+	}
+	m.pathSpeed.With(prometheus.Labels{"direction": "upload", "path": path}).Set(0)
+	m.pathSpeed.With(prometheus.Labels{"direction": "download", "path": path}).Set(0)
+	m.pathPing.With(prometheus.Labels{"path": path}).Set(0)
+}
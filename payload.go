@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/insomniacslk/xjson"
+)
+
+// resultPayload is the JSON representation of a result in the MQTT messages,
+// the audit log, /last.json and the -postprocess-script input and output.
+// Unlike speedTestResult, whose fields follow the speedtest CLI output, its
+// keys are consistently lowercase.
+type resultPayload struct {
+	Download      float64       `json:"download"`
+	Upload        float64       `json:"upload"`
+	Ping          float64       `json:"ping"`
+	Timestamp     time.Time     `json:"timestamp"`
+	BytesSent     uint          `json:"bytes_sent"`
+	BytesReceived uint          `json:"bytes_received"`
+	Jitter        *float64      `json:"jitter,omitempty"`
+	PacketLoss    *float64      `json:"packet_loss,omitempty"`
+	Client        clientPayload `json:"client"`
+	Server        serverPayload `json:"server"`
+}
+
+type clientPayload struct {
+	IP        net.IP `json:"ip"`
+	Lat       string `json:"lat"`
+	Lon       string `json:"lon"`
+	ISP       string `json:"isp"`
+	ISPRating string `json:"isp_rating"`
+	Rating    string `json:"rating"`
+	ISPLavg   string `json:"isp_dl_avg"`
+	ISPULavg  string `json:"isp_ul_avg"`
+	LoggedIn  string `json:"logged_in"`
+	Country   string `json:"country"`
+}
+
+type serverPayload struct {
+	URL     xjson.URL `json:"url"`
+	Lat     string    `json:"lat"`
+	Lon     string    `json:"lon"`
+	Name    string    `json:"name"`
+	Country string    `json:"country"`
+	CC      string    `json:"cc"`
+	Sponsor string    `json:"sponsor"`
+	ID      string    `json:"id"`
+	Host    string    `json:"host"`
+	D       float64   `json:"distance_km"`
+	Latency float64   `json:"latency"`
+}
+
+// newResultPayload returns the JSON representation of res, or nil if res is
+// nil.
+func newResultPayload(res *speedTestResult) *resultPayload {
+	if res == nil {
+		return nil
+	}
+	return &resultPayload{
+		Download:      res.Download,
+		Upload:        res.Upload,
+		Ping:          res.Ping,
+		Timestamp:     res.Timestamp,
+		BytesSent:     res.BytesSent,
+		BytesReceived: res.BytesReceived,
+		Jitter:        res.Jitter,
+		PacketLoss:    res.PacketLoss,
+		Client:        clientPayload(res.Client),
+		Server:        serverPayload(res.Server),
+	}
+}
+
+// result returns the result represented by p. The fields that are not part
+// of the JSON representation are empty.
+func (p *resultPayload) result() *speedTestResult {
+	return &speedTestResult{
+		Download:      p.Download,
+		Upload:        p.Upload,
+		Ping:          p.Ping,
+		Timestamp:     p.Timestamp,
+		BytesSent:     p.BytesSent,
+		BytesReceived: p.BytesReceived,
+		Jitter:        p.Jitter,
+		PacketLoss:    p.PacketLoss,
+		Client:        clientInfo(p.Client),
+		Server:        serverInfo(p.Server),
+	}
+}
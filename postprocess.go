@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// postprocess runs the given script passing the JSON-encoded result on its
+// standard input, and returns the result that the script prints on its
+// standard output. This allows users to correct or enrich results before they
+// are exported. The script is killed after timeout if greater than 0.
+func postprocess(ctx context.Context, script string, timeout time.Duration, res *speedTestResult) (*speedTestResult, error) {
+	in, err := json.Marshal(newResultPayload(res))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal result: %w", err)
+	}
+	ctx, cancel := cliContext(ctx, timeout)
+	defer cancel()
+	cmd := commandContext(ctx, script)
+	var outb, errb bytes.Buffer
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &outb
+	cmd.Stderr = &errb
+	logrus.Debugf("Executing command %+v", cmd)
+	if err := runCommand(cmd); err != nil {
+		return nil, fmt.Errorf("failed to execute post-processing script: %w\nStderr: %s", err, errb.String())
+	}
+	var payload resultPayload
+	if err := json.Unmarshal(outb.Bytes(), &payload); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal post-processed result: %w\nStdout: %s", err, outb.String())
+	}
+	ret := payload.result()
+	// preserve the fields that are not part of the JSON result
+	ret.Interface = res.Interface
+	ret.Retries = res.Retries
+	ret.Duration = res.Duration
+	ret.Started = res.Started
+	ret.Stderr = res.Stderr
+	ret.Raw = res.Raw
+	return ret, nil
+}
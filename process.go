@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// running tracks the child processes that are currently running, so that
+// they can be killed on shutdown.
+var running = struct {
+	sync.Mutex
+	cmds map[*exec.Cmd]struct{}
+	wg   sync.WaitGroup
+}{cmds: make(map[*exec.Cmd]struct{})}
+
+// commandWaitDelay is how long to wait for the output of a command whose
+// context is done, in case a child process we couldn't kill keeps it open.
+const commandWaitDelay = 5 * time.Second
+
+// commandContext is like exec.CommandContext, but it kills the whole process
+// tree when the context is done.
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Cancel = func() error {
+		return killProcessTree(cmd)
+	}
+	cmd.WaitDelay = commandWaitDelay
+	return cmd
+}
+
+// runCommand runs the given command in its own process group, so that the
+// whole process tree can be killed on shutdown. The speedtest CLI may spawn
+// children of its own.
+func runCommand(cmd *exec.Cmd) error {
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	running.Lock()
+	running.cmds[cmd] = struct{}{}
+	running.wg.Add(1)
+	running.Unlock()
+	defer func() {
+		running.Lock()
+		delete(running.cmds, cmd)
+		running.wg.Done()
+		running.Unlock()
+	}()
+	return cmd.Wait()
+}
+
+// waitRunningCommands waits for the running commands to exit, and returns
+// false if they didn't within the given timeout.
+func waitRunningCommands(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		running.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// killRunningCommands kills the process trees of all the running commands.
+func killRunningCommands() {
+	running.Lock()
+	defer running.Unlock()
+	for cmd := range running.cmds {
+		logrus.Infof("Killing process %d", cmd.Process.Pid)
+		if err := killProcessTree(cmd); err != nil {
+			logrus.Warningf("Failed to kill process %d: %v", cmd.Process.Pid, err)
+		}
+	}
+}
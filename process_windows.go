@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// shutdownSignals are the signals that trigger a shutdown. On Windows only
+// os.Interrupt (Ctrl+C, Ctrl+Break, or a service stop delivered as a console
+// control event) is available.
+var shutdownSignals = []os.Signal{os.Interrupt}
+
+// shellArgs returns the command line that runs the given command through the
+// command interpreter.
+func shellArgs(command string) []string {
+	return []string{"cmd", "/C", command}
+}
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// killProcessTree kills the given command and all of its children. Windows
+// has no process groups that can be signaled, so use taskkill's /T option.
+func killProcessTree(cmd *exec.Cmd) error {
+	return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+}
@@ -0,0 +1,113 @@
+package main
+
+import "math"
+
+// qualityValues holds a value for each component of the connection quality
+// score. It is used both for the weights and for the targets.
+type qualityValues struct {
+	Download float64
+	Upload   float64
+	Ping     float64
+	Jitter   float64
+	Loss     float64
+}
+
+var defaultQualityWeights = qualityValues{
+	Download: 1,
+	Upload:   1,
+	Ping:     1,
+	Jitter:   1,
+	Loss:     1,
+}
+
+// defaultQualityTargets are the values at which each component gets the full
+// score: download and upload in bits per second, ping and jitter in
+// milliseconds, and packet loss in percent.
+var defaultQualityTargets = qualityValues{
+	Download: 100e6,
+	Upload:   20e6,
+	Ping:     20,
+	Jitter:   5,
+	Loss:     5,
+}
+
+// parseQualityValues parses a comma-separated list of name=value pairs, e.g.
+// "download=2,jitter=0", on top of the given defaults. Valid names are
+// download, upload, ping, jitter and loss.
+func parseQualityValues(s string, defaults qualityValues) (*qualityValues, error) {
+	v := defaults
+	if err := parseWeights(s, map[string]*float64{
+		"download": &v.Download,
+		"upload":   &v.Upload,
+		"ping":     &v.Ping,
+		"jitter":   &v.Jitter,
+		"loss":     &v.Loss,
+	}); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// resultQualityInputs returns the measurements of a result used by
+// connectionQuality. Jitter and packet loss are NaN if the backend doesn't
+// report them.
+func resultQualityInputs(res *speedTestResult) qualityValues {
+	in := qualityValues{
+		Download: res.Download,
+		Upload:   res.Upload,
+		Ping:     res.Ping,
+		Jitter:   math.NaN(),
+		Loss:     math.NaN(),
+	}
+	if res.Jitter != nil {
+		in.Jitter = *res.Jitter
+	}
+	if res.PacketLoss != nil {
+		in.Loss = *res.PacketLoss * 100
+	}
+	return in
+}
+
+// connectionQuality returns a score between 0 and 100 summarizing the quality
+// of the connection. It is 100 times the weighted average of the following
+// scores, each between 0 and 1:
+//   - download and upload: the speed divided by the target, up to 1
+//   - ping and jitter: the target divided by the measured value, up to 1. A
+//     ping of 0 means that the measurement failed, and scores 0
+//   - loss: 1 minus the packet loss divided by the target, down to 0, so that
+//     the target is the loss at which the score is 0
+//
+// Measurements that are NaN are not reported by the backend, and don't
+// contribute to the score. If no measurement is available, NaN is returned.
+func connectionQuality(in, targets, weights qualityValues) float64 {
+	ratio := func(num, den float64) float64 {
+		if den <= 0 {
+			return 1
+		}
+		return math.Min(1, num/den)
+	}
+	components := []struct {
+		value, score, weight float64
+	}{
+		{in.Download, ratio(in.Download, targets.Download), weights.Download},
+		{in.Upload, ratio(in.Upload, targets.Upload), weights.Upload},
+		{in.Ping, ratio(targets.Ping, in.Ping), weights.Ping},
+		{in.Jitter, ratio(targets.Jitter, in.Jitter), weights.Jitter},
+		{in.Loss, math.Max(0, 1-ratio(in.Loss, targets.Loss)), weights.Loss},
+	}
+	if in.Ping <= 0 {
+		components[2].score = 0
+	}
+	var sum, total float64
+	for _, c := range components {
+		if math.IsNaN(c.value) {
+			continue
+		}
+		sum += c.weight * c.score
+		total += c.weight
+	}
+	if total == 0 {
+		return math.NaN()
+	}
+	return 100 * sum / total
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// resultStore holds the last successful speedtest result. It is safe for
+// concurrent use.
+type resultStore struct {
+	mu   sync.RWMutex
+	last *speedTestResult
+	// updated is when last was set, according to the exporter's clock
+	updated time.Time
+}
+
+func (s *resultStore) set(res *speedTestResult) {
+	s.setAt(res, time.Now())
+}
+
+// setAt sets the last result, obtained at the given time.
+func (s *resultStore) setAt(res *speedTestResult, updated time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last = res
+	s.updated = updated
+}
+
+// snapshot returns the last successful result and when it was obtained, or
+// nil if there is none.
+func (s *resultStore) snapshot() (*speedTestResult, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.last, s.updated
+}
+
+// get returns the last successful result, or nil if there is none.
+func (s *resultStore) get() *speedTestResult {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.last
+}
+
+// age returns the time elapsed since the last result was obtained, and false
+// if there is none.
+func (s *resultStore) age() (time.Duration, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.last == nil {
+		return 0, false
+	}
+	return time.Since(s.updated), true
+}
+
+// serverIDStore holds a server ID. It is safe for concurrent use.
+type serverIDStore struct {
+	mu sync.Mutex
+	id int
+}
+
+func (s *serverIDStore) set(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.id = id
+}
+
+// get returns the server ID, or 0 if not set.
+func (s *serverIDStore) get() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.id
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// retryableError wraps a retryable error together with the delay requested
+// by the server before retrying, if any.
+type retryableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *retryableError) Error() string {
+	if e.retryAfter > 0 {
+		return fmt.Sprintf("%v (retry after %s)", e.err, e.retryAfter)
+	}
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// retryDelay returns how long to wait before retrying after the given error.
+// It honors the server's Retry-After indication if present, and falls back to
+// `fallback` otherwise.
+func retryDelay(err error, fallback time.Duration) time.Duration {
+	var rerr *retryableError
+	if errors.As(err, &rerr) && rerr.retryAfter > 0 {
+		return rerr.retryAfter
+	}
+	return fallback
+}
+
+// sleepContext sleeps for d, and returns false if ctx is done before.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// backoffInterval returns the delay before the given retry attempt, starting
+// from 1: base, doubled at every attempt up to max.
+func backoffInterval(base, max time.Duration, attempt int) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
+
+var retryAfterRegexp = regexp.MustCompile(`(?i)retry-after:?\s*(.+)$`)
+
+// parseRetryAfter parses the value of a Retry-After header, which can be
+// either a number of seconds or an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// connectionErrorPatterns match the errors printed by the speedtest CLI when
+// it cannot reach the network at all, e.g. because the WAN is momentarily
+// down.
+var connectionErrorPatterns = []string{
+	"connection refused",
+	"network is unreachable",
+	"no route to host",
+	"name or service not known",
+	"temporary failure in name resolution",
+	"nodename nor servname provided",
+	"no address associated with hostname",
+	"getaddrinfo failed",
+}
+
+// retryableHTTPCodes are the HTTP status codes returned by the SpeedTest.net
+// infrastructure that are worth retrying.
+var retryableHTTPCodes = map[int]bool{
+	http.StatusForbidden:           true,
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+}
+
+// retryableCLIError parses the stderr of a failed speedtest CLI run and
+// returns a retryable error if the failure is temporary, or nil otherwise.
+// Connection and DNS resolution failures are reported as errConnection.
+func retryableCLIError(stderr string) error {
+	var (
+		retryableCode int
+		retryAfter    time.Duration
+	)
+	scanner := bufio.NewScanner(strings.NewReader(stderr))
+	for scanner.Scan() {
+		line := scanner.Text()
+		lower := strings.ToLower(line)
+		for _, pattern := range connectionErrorPatterns {
+			if strings.Contains(lower, pattern) {
+				return &retryableError{err: fmt.Errorf("%w: %s", errConnection, strings.TrimSpace(line))}
+			}
+		}
+		if matches := retryAfterRegexp.FindStringSubmatch(line); matches != nil {
+			retryAfter = parseRetryAfter(matches[1])
+			continue
+		}
+		var (
+			errCode int
+			errMsg  string
+		)
+		n, err := fmt.Fscanf(strings.NewReader(line), "ERROR: HTTP Error %d: %s\n", &errCode, &errMsg)
+		if err != nil || n != 2 {
+			// not an HTTP error string, ignore
+			continue
+		}
+		// at this point we know there's an HTTP error. If it's 403
+		// Forbidden we know something's being updated on the SpeedTest
+		// side, so we can wait and retry. Rate limiting and server errors
+		// are usually transient too
+		if retryableHTTPCodes[errCode] {
+			retryableCode = errCode
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logrus.Warningf("Text scanner failed: %v", err)
+	}
+	if retryableCode == 0 {
+		return nil
+	}
+	return &retryableError{err: fmt.Errorf("%w: HTTP %d", errRetryable, retryableCode), retryAfter: retryAfter}
+}
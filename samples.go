@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// runSamples runs the given speedtest function n times and returns the
+// successful results. An error is returned only if all the runs fail, in
+// which case it is the error of the last run.
+func runSamples(n int, run func() (*speedTestResult, error)) ([]*speedTestResult, error) {
+	var (
+		results []*speedTestResult
+		lastErr error
+	)
+	for i := 0; i < n; i++ {
+		if n > 1 {
+			logrus.Infof("Running sample %d of %d", i+1, n)
+		}
+		res, err := run()
+		if err != nil {
+			if n > 1 {
+				logrus.Warningf("Sample %d of %d failed: %v", i+1, n, err)
+			}
+			lastErr = err
+			continue
+		}
+		results = append(results, res)
+	}
+	if len(results) == 0 {
+		return nil, lastErr
+	}
+	return results, nil
+}
+
+// meanResult returns a result whose speeds, ping and transferred bytes are
+// the mean of the given results. All the other fields are taken from the last
+// result.
+func meanResult(results []*speedTestResult) *speedTestResult {
+	ret := *results[len(results)-1]
+	var (
+		download, upload, ping float64
+		sent, received         uint
+	)
+	for _, res := range results {
+		download += res.Download
+		upload += res.Upload
+		ping += res.Ping
+		sent += res.BytesSent
+		received += res.BytesReceived
+	}
+	n := float64(len(results))
+	ret.Download = download / n
+	ret.Upload = upload / n
+	ret.Ping = ping / n
+	ret.BytesSent = sent / uint(len(results))
+	ret.BytesReceived = received / uint(len(results))
+	return &ret
+}
+
+// median returns the median of the values returned by `get` for each result.
+func median(results []*speedTestResult, get func(*speedTestResult) float64) float64 {
+	values := make([]float64, 0, len(results))
+	for _, res := range results {
+		values = append(values, get(res))
+	}
+	sort.Float64s(values)
+	mid := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[mid-1] + values[mid]) / 2
+	}
+	return values[mid]
+}
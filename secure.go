@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// runSecureComparison runs one speedtest with --secure and one without, and
+// exports the results with a secure label, to measure the HTTPS overhead.
+// The server IDs and the insecure option in opts are ignored, since
+// speedtest-cli can't use --secure with a custom list of servers. It returns
+// the number of bytes transferred by the successful tests.
+func runSecureComparison(ctx context.Context, m *metrics, cliPath string, opts speedtestOptions) float64 {
+	opts.serverIDs = nil
+	var bytes float64
+	for _, secure := range []bool{true, false} {
+		opts.insecure = !secure
+		label := strconv.FormatBool(secure)
+		logrus.Infof("Running speed test with secure=%s", label)
+		res, err := speedtest(ctx, cliPath, opts)
+		if err != nil {
+			logrus.Warningf("Failed to run speed test with secure=%s: %v", label, err)
+			m.setSecureError(label)
+			continue
+		}
+		if !opts.pingOnly {
+			m.secureSpeed.With(prometheus.Labels{"direction": "upload", "secure": label}).Set(m.roundSpeed(res.Upload))
+			m.secureSpeed.With(prometheus.Labels{"direction": "download", "secure": label}).Set(m.roundSpeed(res.Download))
+		}
+		m.securePing.With(prometheus.Labels{"secure": label}).Set(res.Ping)
+		bytes += float64(res.BytesSent + res.BytesReceived)
+	}
+	return bytes
+}
+
+// setSecureError resets the metrics of one side of the comparison after a
+// failure, following the same rules as setError.
+func (m *metrics) setSecureError(secure string) {
+	if m.noZeroOnError {
+		m.secureSpeed.DeletePartialMatch(prometheus.Labels{"secure": secure})
+		m.securePing.With(prometheus.Labels{"secure": secure}).Set(math.NaN())
+		return
+	}
+	m.secureSpeed.With(prometheus.Labels{"direction": "upload", "secure": secure}).Set(0)
+	m.secureSpeed.With(prometheus.Labels{"direction": "download", "secure": secure}).Set(0)
+	m.securePing.With(prometheus.Labels{"secure": secure}).Set(0)
+}
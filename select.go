@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// serverSelections are the valid values of -select.
+var serverSelections = map[string]bool{
+	"cli":     true,
+	"latency": true,
+}
+
+// lowestLatencyServer returns the ID of the server with the lowest latency
+// among the candidates. It runs a latency-only speedtest against all of them,
+// since speedtest-cli picks the lowest-latency server among the given ones.
+func lowestLatencyServer(ctx context.Context, cliPath string, opts speedtestOptions) (int, error) {
+	opts.pingOnly = true
+	res, err := speedtest(ctx, cliPath, opts)
+	if err != nil {
+		return 0, fmt.Errorf("latency test failed: %w", err)
+	}
+	id, err := strconv.Atoi(res.Server.ID)
+	if err != nil {
+		return 0, fmt.Errorf("invalid server ID %q: %w", res.Server.ID, err)
+	}
+	logrus.Infof("Server %s (ID %d) has the lowest latency among %d candidates: %.2f ms", res.Server.Sponsor, id, len(opts.serverIDs), res.Server.Latency)
+	return id, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// serverFilters select the candidate servers from the server list.
+type serverFilters struct {
+	// regexp matches the names of the servers to keep, if not nil
+	regexp *regexp.Regexp
+	// maxDistanceKm is the maximum distance of the servers to keep, if
+	// greater than 0
+	maxDistanceKm       int
+	excludeZeroDistance bool
+	// country is the country of the servers to keep, if not empty
+	country string
+}
+
+// filter returns the servers that pass the filters, in the same order.
+func (f serverFilters) filter(servers []SpeedtestServer) []SpeedtestServer {
+	logrus.Infof("Found %d total servers (before filtering)", len(servers))
+	if f.regexp != nil {
+		// filter servers by regexp first
+		logrus.Infof("Filtering servers matching regexp %q", f.regexp)
+		servers = filterServers(servers, func(s SpeedtestServer) bool { return f.regexp.MatchString(s.Name) })
+		logrus.Infof("Remaining servers after regexp filtering: %d", len(servers))
+	}
+	if f.maxDistanceKm > 0 {
+		logrus.Infof("Filtering servers within %d km", f.maxDistanceKm)
+		servers = filterServers(servers, func(s SpeedtestServer) bool { return s.DistanceKm <= float64(f.maxDistanceKm) })
+		logrus.Infof("Remaining servers after distance filtering: %d", len(servers))
+	}
+	if f.country != "" {
+		logrus.Infof("Filtering servers in %s", f.country)
+		servers = filterServers(servers, func(s SpeedtestServer) bool { return strings.EqualFold(s.Country, f.country) })
+		logrus.Infof("Remaining servers after country filtering: %d", len(servers))
+	}
+	if f.excludeZeroDistance {
+		before := len(servers)
+		servers = filterServers(servers, func(s SpeedtestServer) bool { return s.DistanceKm != 0 })
+		logrus.Infof("Excluded %d servers with zero distance, remaining: %d", before-len(servers), len(servers))
+	}
+	return servers
+}
+
+// filterServers returns the servers for which keep returns true.
+func filterServers(servers []SpeedtestServer, keep func(SpeedtestServer) bool) []SpeedtestServer {
+	var ret []SpeedtestServer
+	for _, s := range servers {
+		if keep(s) {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
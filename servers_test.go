@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestServerFiltersMaxDistance(t *testing.T) {
+	servers := []SpeedtestServer{
+		{ID: 1, Name: "exact", DistanceKm: 12.0},
+		{ID: 2, Name: "just beyond", DistanceKm: 12.34},
+		{ID: 3, Name: "below 1 km", DistanceKm: 0.5},
+	}
+	tests := []struct {
+		name    string
+		filters serverFilters
+		wantIDs []int
+	}{
+		{
+			name:    "max distance",
+			filters: serverFilters{maxDistanceKm: 12},
+			wantIDs: []int{1, 3},
+		},
+		{
+			name:    "max distance excluding zero distance",
+			filters: serverFilters{maxDistanceKm: 12, excludeZeroDistance: true},
+			wantIDs: []int{1, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotIDs []int
+			for _, s := range tt.filters.filter(servers) {
+				gotIDs = append(gotIDs, s.ID)
+			}
+			if !reflect.DeepEqual(gotIDs, tt.wantIDs) {
+				t.Errorf("got server IDs %v, want %v", gotIDs, tt.wantIDs)
+			}
+		})
+	}
+}
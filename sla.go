@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// slaThresholds are the minimum download speed and maximum ping guaranteed by
+// the ISP. Zero values are not checked.
+type slaThresholds struct {
+	DownloadBits float64
+	PingMsec     float64
+}
+
+// breached returns whether the given result violates the SLA.
+func (t slaThresholds) breached(res *speedTestResult) bool {
+	if t.DownloadBits > 0 && res.Download < t.DownloadBits {
+		return true
+	}
+	if t.PingMsec > 0 && res.Ping > t.PingMsec {
+		return true
+	}
+	return false
+}
+
+// slaTracker accumulates the time spent in breach of the SLA. A breach starts
+// with the first result violating the SLA and ends with the first result
+// that doesn't. It is safe for concurrent use.
+type slaTracker struct {
+	mu    sync.Mutex
+	since time.Time
+	total time.Duration
+}
+
+// set records whether the latest result violates the SLA.
+func (s *slaTracker) set(breached bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case breached && s.since.IsZero():
+		s.since = time.Now()
+	case !breached && !s.since.IsZero():
+		s.total += time.Since(s.since)
+		s.since = time.Time{}
+	}
+}
+
+// duration returns the total time spent in breach, including the current
+// breach if any.
+func (s *slaTracker) duration() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.since.IsZero() {
+		return s.total
+	}
+	return s.total + time.Since(s.since)
+}